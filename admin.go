@@ -0,0 +1,62 @@
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var _ caddy.AdminRouter = (*adminAPI)(nil)
+
+// adminAPI exposes the learned ignore rules through the Caddy admin API
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.shadow",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/shadow/learned", Handler: caddy.AdminHandlerFunc(a.handleLearned)},
+		{Pattern: "/shadow/learned/ignore_fields", Handler: caddy.AdminHandlerFunc(a.handleIgnoreFields)},
+	}
+}
+
+// handleLearned lists everything learned so far, by name and route
+func (a *adminAPI) handleLearned(w http.ResponseWriter, r *http.Request) error {
+	learned := make(map[string]map[string]learnedRoute)
+	return writeLearned(w, r, func(name string, l *learner) {
+		learned[name] = l.snapshot()
+	}, learned)
+}
+
+// handleIgnoreFields lists the learned ignore rules, by name, in the form of the ignore_fields config
+func (a *adminAPI) handleIgnoreFields(w http.ResponseWriter, r *http.Request) error {
+	rules := make(map[string]map[string][]string)
+	return writeLearned(w, r, func(name string, l *learner) {
+		rules[name] = l.rules()
+	}, rules)
+}
+
+func writeLearned(w http.ResponseWriter, r *http.Request, collect func(name string, l *learner), v any) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	learners.Range(func(key, value any) bool {
+		collect(key.(string), value.(*learner))
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
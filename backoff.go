@@ -0,0 +1,161 @@
+package shadow
+
+import (
+	"fmt"
+	"math"
+	rtmetrics "runtime/metrics"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// BackoffConfig protects the primary from the cost of shadowing. The overhead shadowing adds to the primary path (time
+// spent cloning, multiplexing the request body, and buffering the response) is measured on every shadowed request.
+// Whenever the p99 overhead passes MaxOverhead, or process memory passes MaxMemory, the effective sample rate is halved.
+// Once both are back under their thresholds, the effective sample rate recovers in steps towards the configured rate.
+type BackoffConfig struct {
+	MaxOverhead string `json:"max_overhead,omitempty"`
+	MaxMemory   string `json:"max_memory,omitempty"`
+	Interval    string `json:"interval,omitempty"`
+}
+
+const (
+	backoffMinFactor    = 1.0 / 1024
+	backoffRecoveryStep = 0.1
+	backoffMaxSamples   = 4096
+)
+
+type backoff struct {
+	mu sync.Mutex
+
+	samples []time.Duration
+
+	// lastEval is the time of the last evaluation, in Unix nanoseconds
+	lastEval atomic.Int64
+
+	// factor is the float64 bits of the multiplier applied to the configured sample rate
+	factor atomic.Uint64
+
+	maxOverhead time.Duration
+	maxMemory   uint64
+	interval    time.Duration
+	now         func() time.Time
+	readMemory  func() uint64
+	onChange    func(factor float64, p99 time.Duration, memory uint64)
+}
+
+func newBackoff(cfg *BackoffConfig, now func() time.Time) (b *backoff, err error) {
+	b = &backoff{
+		interval:   10 * time.Second,
+		now:        now,
+		readMemory: readProcessMemory,
+		onChange:   func(float64, time.Duration, uint64) {},
+	}
+	b.factor.Store(math.Float64bits(1))
+
+	if cfg.MaxOverhead != "" {
+		b.maxOverhead, err = time.ParseDuration(cfg.MaxOverhead)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing max_overhead: %w", err)
+		}
+	}
+	if cfg.MaxMemory != "" {
+		b.maxMemory, err = humanize.ParseBytes(cfg.MaxMemory)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing max_memory: %w", err)
+		}
+	}
+	if b.maxOverhead <= 0 && b.maxMemory == 0 {
+		return nil, fmt.Errorf("at least one of max_overhead or max_memory is required")
+	}
+	if cfg.Interval != "" {
+		b.interval, err = time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing interval: %w", err)
+		}
+	}
+
+	b.lastEval.Store(now().UnixNano())
+	return b, nil
+}
+
+// observeOverhead records the overhead shadowing added to the primary path for a shadowed request
+func (h *Handler) observeOverhead(overhead time.Duration) {
+	if h.MetricsName != "" {
+		h.metrics.overhead.Observe(overhead.Seconds())
+	}
+	if h.backoff != nil {
+		h.backoff.observe(overhead)
+	}
+}
+
+// observe records the overhead shadowing added to a primary request
+func (b *backoff) observe(overhead time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.samples) < backoffMaxSamples {
+		b.samples = append(b.samples, overhead)
+	}
+}
+
+// rate returns the effective sample rate for the configured rate, re-evaluating the back-off once per interval
+func (b *backoff) rate(configured float64) float64 {
+	if b.now().UnixNano()-b.lastEval.Load() >= int64(b.interval) {
+		b.evaluate()
+	}
+	return configured * math.Float64frombits(b.factor.Load())
+}
+
+func (b *backoff) evaluate() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Another request may have beaten us to it
+	now := b.now().UnixNano()
+	if now-b.lastEval.Load() < int64(b.interval) {
+		return
+	}
+	b.lastEval.Store(now)
+
+	var p99 time.Duration
+	if len(b.samples) > 0 {
+		slices.Sort(b.samples)
+		p99 = b.samples[(len(b.samples)*99)/100]
+		b.samples = b.samples[:0]
+	}
+
+	var memory uint64
+	if b.maxMemory > 0 {
+		memory = b.readMemory()
+	}
+
+	factor := math.Float64frombits(b.factor.Load())
+	newFactor := factor
+	if (b.maxOverhead > 0 && p99 > b.maxOverhead) || (b.maxMemory > 0 && memory > b.maxMemory) {
+		newFactor = max(factor/2, backoffMinFactor)
+	} else if factor < 1 {
+		newFactor = min(factor+backoffRecoveryStep, 1)
+	}
+
+	if newFactor != factor {
+		b.factor.Store(math.Float64bits(newFactor))
+		b.onChange(newFactor, p99, memory)
+	}
+}
+
+// readProcessMemory returns the memory mapped by the Go runtime which hasn't been released back to the OS
+func readProcessMemory() uint64 {
+	samples := []rtmetrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	rtmetrics.Read(samples)
+	if samples[0].Value.Kind() != rtmetrics.KindUint64 || samples[1].Value.Kind() != rtmetrics.KindUint64 {
+		return 0
+	}
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
@@ -0,0 +1,62 @@
+package shadow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	now := time.Unix(0, 0)
+	b, err := newBackoff(&BackoffConfig{
+		MaxOverhead: "5ms",
+		MaxMemory:   "1GiB",
+		Interval:    "10s",
+	}, func() time.Time { return now })
+	if err != nil {
+		t.Fatalf("newBackoff() error = %v", err)
+	}
+	memory := uint64(0)
+	b.readMemory = func() uint64 { return memory }
+
+	// Within the interval, observations don't change the rate
+	for range 100 {
+		b.observe(20 * time.Millisecond)
+	}
+	if got := b.rate(0.5); got != 0.5 {
+		t.Fatalf("rate() = %v before the interval elapsed, want 0.5", got)
+	}
+
+	now = now.Add(10 * time.Second)
+	if got := b.rate(0.5); got != 0.25 {
+		t.Errorf("rate() = %v with p99 overhead over the threshold, want 0.25", got)
+	}
+
+	now = now.Add(10 * time.Second)
+	memory = 2 << 30
+	if got := b.rate(0.5); got != 0.125 {
+		t.Errorf("rate() = %v with memory over the threshold, want 0.125", got)
+	}
+
+	// Once everything is healthy again, the rate recovers step by step
+	memory = 0
+	for range 100 {
+		b.observe(time.Millisecond)
+	}
+	now = now.Add(10 * time.Second)
+	if got := b.rate(1); got != 0.25+backoffRecoveryStep {
+		t.Errorf("rate() = %v while recovering, want %v", got, 0.25+backoffRecoveryStep)
+	}
+	for range 10 {
+		now = now.Add(10 * time.Second)
+		b.rate(1)
+	}
+	if got := b.rate(1); got != 1 {
+		t.Errorf("rate() = %v after recovering, want 1", got)
+	}
+}
+
+func TestNewBackoff_requiresThreshold(t *testing.T) {
+	if _, err := newBackoff(&BackoffConfig{Interval: "1s"}, time.Now); err == nil {
+		t.Errorf("newBackoff() without thresholds should fail")
+	}
+}
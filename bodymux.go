@@ -0,0 +1,242 @@
+package shadow
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	largeBodySkip  = "skip"
+	largeBodySpill = "spill"
+)
+
+// skipReasonBodyIncomplete is why a response isn't compared when the request body couldn't be read in full, so the
+// shadow never saw all of it
+const skipReasonBodyIncomplete = "body_incomplete"
+
+var (
+	errBodyTooLarge = errors.New("request body is too large to mirror")
+	errBodyUnread   = errors.New("request body wasn't read in full by the primary")
+)
+
+// bodyMux multiplexes a read-once request body to the primary and shadowed requests. The primary reads straight from
+// the original body, and everything it reads is captured for the shadows. Each shadow reads the captured body at its
+// own pace, blocking until the primary has read more of it or reached the end. The primary never waits on a shadow.
+//
+// At most maxSize bytes are held in memory. Past that, the captured body either spills to a temp file, or the shadow
+// fails with errBodyTooLarge.
+type bodyMux struct {
+	src     io.ReadCloser
+	maxSize int64
+	spill   bool
+
+	mu sync.Mutex
+	// changed is closed, and replaced, whenever more of the body has been captured
+	changed  chan struct{}
+	buf      *bytes.Buffer
+	file     *os.File
+	size     int64
+	srcErr   error
+	overflow bool
+	refs     int
+
+	// open is the number of shadow readers which haven't been closed yet
+	open int
+}
+
+// newBodyMux multiplexes src to the primary and the given number of shadows. Each of the shadows must call shadow
+// exactly once.
+func newBodyMux(src io.ReadCloser, maxSize int64, spill bool, shadows int) *bodyMux {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return &bodyMux{
+		src:     src,
+		maxSize: maxSize,
+		spill:   spill,
+		changed: make(chan struct{}),
+		buf:     buf,
+		refs:    1 + shadows,
+		open:    shadows,
+	}
+}
+
+// primary returns the body for the primary request. Closing it is a no-op, since the server owns the original body.
+func (m *bodyMux) primary() io.ReadCloser {
+	return &muxPrimaryReader{m: m}
+}
+
+// shadow returns the body for a shadowed request. It must be closed once the shadowed request is done.
+func (m *bodyMux) shadow() io.ReadCloser {
+	return &muxShadowReader{m: m, done: make(chan struct{})}
+}
+
+// incomplete returns why the shadows were cut off from part of the body, if they were: either it was larger than
+// maxSize, or it wasn't read in full, by the primary or because of the client. A request without a body is never
+// incomplete.
+func (m *bodyMux) incomplete() (reason string) {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.overflow:
+		return dropReasonBodyTooLarge
+	case m.srcErr != nil && m.srcErr != io.EOF:
+		return skipReasonBodyIncomplete
+	}
+	return ""
+}
+
+// finishPrimary is called once the primary is done with the body. The server owns the body, and reading the rest of it
+// once the primary is done could hold up the connection for as long as the client takes to send it, so if the primary
+// didn't read the whole body, the shadows are cut off where it stopped.
+func (m *bodyMux) finishPrimary() {
+	m.mu.Lock()
+	if m.srcErr == nil {
+		m.srcErr = errBodyUnread
+		close(m.changed)
+		m.changed = make(chan struct{})
+	}
+	m.mu.Unlock()
+	m.release()
+}
+
+func (m *bodyMux) capture(p []byte, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(p) > 0 && !m.overflow && m.open > 0 {
+		m.write(p)
+	}
+	if err != nil {
+		m.srcErr = err
+	}
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// write must be called while holding m.mu
+func (m *bodyMux) write(p []byte) {
+	if m.file == nil && m.size+int64(len(p)) > m.maxSize {
+		if !m.spill {
+			m.overflow = true
+			m.buf.Reset()
+			return
+		}
+
+		var err error
+		m.file, err = os.CreateTemp("", "caddy-shadow-body-*")
+		if err == nil {
+			_, err = m.file.Write(m.buf.Bytes())
+		}
+		if err != nil {
+			m.overflow = true
+			return
+		}
+		m.buf.Reset()
+	}
+
+	if m.file != nil {
+		if _, err := m.file.Write(p); err != nil {
+			m.overflow = true
+			return
+		}
+	} else {
+		m.buf.Write(p)
+	}
+	m.size += int64(len(p))
+}
+
+func (m *bodyMux) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refs--
+	if m.refs > 0 {
+		return
+	}
+
+	bufferPool.Put(m.buf)
+	m.buf = nil
+	if m.file != nil {
+		_ = m.file.Close()
+		_ = os.Remove(m.file.Name())
+		m.file = nil
+	}
+}
+
+type muxPrimaryReader struct {
+	m *bodyMux
+}
+
+func (r *muxPrimaryReader) Read(p []byte) (n int, err error) {
+	n, err = r.m.src.Read(p)
+	r.m.capture(p[:n], err)
+	return
+}
+
+func (r *muxPrimaryReader) Close() error {
+	return nil
+}
+
+type muxShadowReader struct {
+	m         *bodyMux
+	offset    int64
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *muxShadowReader) Read(p []byte) (n int, err error) {
+	m := r.m
+	for {
+		m.mu.Lock()
+		switch {
+		case r.closed:
+			m.mu.Unlock()
+			return 0, os.ErrClosed
+		case m.overflow:
+			m.mu.Unlock()
+			return 0, errBodyTooLarge
+		case r.offset < m.size:
+			if m.file != nil {
+				n, err = m.file.ReadAt(p[:min(int64(len(p)), m.size-r.offset)], r.offset)
+				if err == io.EOF {
+					err = nil
+				}
+			} else {
+				n = copy(p, m.buf.Bytes()[r.offset:])
+			}
+			r.offset += int64(n)
+			m.mu.Unlock()
+			return n, err
+		case m.srcErr != nil:
+			m.mu.Unlock()
+			return 0, m.srcErr
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-r.done:
+		}
+	}
+}
+
+func (r *muxShadowReader) Close() error {
+	r.closeOnce.Do(func() {
+		r.m.mu.Lock()
+		r.closed = true
+		r.m.open--
+		r.m.mu.Unlock()
+		close(r.done)
+		r.m.release()
+	})
+	return nil
+}
@@ -0,0 +1,177 @@
+package shadow
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBodyMux(t *testing.T) {
+	body := strings.Repeat("caddy-shadow ", 1000)
+
+	tests := []struct {
+		name       string
+		maxSize    int64
+		spill      bool
+		wantShadow string
+		wantErr    error
+	}{
+		{name: "in memory", maxSize: 1 << 20, wantShadow: body},
+		{name: "too large", maxSize: 100, wantErr: errBodyTooLarge},
+		{name: "spilled", maxSize: 100, spill: true, wantShadow: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newBodyMux(io.NopCloser(iotest.HalfReader(strings.NewReader(body))), tt.maxSize, tt.spill, 1)
+			shadow := m.shadow()
+
+			// Start reading the shadow body before the primary has read anything
+			type result struct {
+				body []byte
+				err  error
+			}
+			shadowResult := make(chan result)
+			go func() {
+				b, err := io.ReadAll(shadow)
+				shadowResult <- result{b, err}
+			}()
+
+			primary, err := io.ReadAll(iotest.OneByteReader(m.primary()))
+			if err != nil || string(primary) != body {
+				t.Fatalf("primary read %d bytes, error = %v", len(primary), err)
+			}
+
+			got := <-shadowResult
+			if !errors.Is(got.err, tt.wantErr) {
+				t.Errorf("shadow read error = %v, want %v", got.err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(got.body) != tt.wantShadow {
+				t.Errorf("shadow read %d bytes, want %d", len(got.body), len(tt.wantShadow))
+			}
+
+			var spilled string
+			if m.file != nil {
+				spilled = m.file.Name()
+			}
+			m.finishPrimary()
+			_ = shadow.Close()
+			if spilled != "" {
+				if _, err = os.Stat(spilled); !os.IsNotExist(err) {
+					t.Errorf("spilled body %s was not removed", spilled)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyMux_primaryDidNotRead(t *testing.T) {
+	m := newBodyMux(io.NopCloser(strings.NewReader("unread body")), 1<<20, false, 1)
+	shadow := m.shadow()
+	defer shadow.Close()
+
+	m.finishPrimary()
+
+	// The rest of the body is never read on the shadow's behalf once the primary is done
+	got, err := io.ReadAll(shadow)
+	if !errors.Is(err, errBodyUnread) || len(got) > 0 {
+		t.Errorf("shadow read %q, error = %v, want nothing and %v", got, err, errBodyUnread)
+	}
+}
+
+// endlessReader never runs out, counting how many times it's read
+type endlessReader struct {
+	reads int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.reads++
+	return len(p), nil
+}
+
+func TestBodyMux_finishPrimary(t *testing.T) {
+	t.Run("unread body", func(t *testing.T) {
+		src, upload := io.Pipe()
+		defer upload.Close()
+		m := newBodyMux(src, 1<<20, false, 1)
+		shadow := m.shadow()
+		defer shadow.Close()
+
+		// The primary read part of the body, and the rest is never read once it's done, even if it arrives later
+		go func() { _, _ = upload.Write([]byte("part")) }()
+		if _, err := io.ReadFull(m.primary(), make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		m.finishPrimary()
+		if got, err := io.ReadAll(shadow); !errors.Is(err, errBodyUnread) || string(got) != "part" {
+			t.Errorf("shadow read %q, error = %v, want the part the primary read and %v", got, err, errBodyUnread)
+		}
+		if m.incomplete() != skipReasonBodyIncomplete {
+			t.Errorf("incomplete() = %q, want %q", m.incomplete(), skipReasonBodyIncomplete)
+		}
+	})
+
+	t.Run("read in full", func(t *testing.T) {
+		m := newBodyMux(io.NopCloser(strings.NewReader("body")), 1<<20, false, 1)
+		shadow := m.shadow()
+		defer shadow.Close()
+
+		if _, err := io.ReadAll(m.primary()); err != nil {
+			t.Fatal(err)
+		}
+		m.finishPrimary()
+		if got, err := io.ReadAll(shadow); err != nil || string(got) != "body" {
+			t.Errorf("shadow read %q, error = %v, want the whole body", got, err)
+		}
+		if m.incomplete() != "" {
+			t.Errorf("incomplete() = %q, want the body complete", m.incomplete())
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		src := &endlessReader{}
+		m := newBodyMux(io.NopCloser(src), 100, false, 1)
+		shadow := m.shadow()
+		defer shadow.Close()
+
+		_, _ = io.ReadFull(m.primary(), make([]byte, 200))
+		m.finishPrimary()
+		if _, err := io.ReadAll(shadow); !errors.Is(err, errBodyTooLarge) {
+			t.Errorf("shadow read error = %v, want %v", err, errBodyTooLarge)
+		}
+		if m.incomplete() != dropReasonBodyTooLarge {
+			t.Errorf("incomplete() = %q, want %q", m.incomplete(), dropReasonBodyTooLarge)
+		}
+	})
+
+	t.Run("body cut short", func(t *testing.T) {
+		m := newBodyMux(io.NopCloser(iotest.ErrReader(io.ErrUnexpectedEOF)), 1<<20, false, 1)
+		shadow := m.shadow()
+		defer shadow.Close()
+
+		_, _ = io.ReadAll(m.primary())
+		m.finishPrimary()
+		if _, err := io.ReadAll(shadow); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("shadow read error = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+		if m.incomplete() != skipReasonBodyIncomplete {
+			t.Errorf("incomplete() = %q, want %q", m.incomplete(), skipReasonBodyIncomplete)
+		}
+	})
+}
+
+func TestBodyMux_shadowClosed(t *testing.T) {
+	m := newBodyMux(io.NopCloser(strings.NewReader("body")), 1<<20, false, 1)
+	shadow := m.shadow()
+	_ = shadow.Close()
+
+	if _, err := shadow.Read(make([]byte, 4)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Read() after Close() error = %v, want %v", err, os.ErrClosed)
+	}
+	if b, err := io.ReadAll(m.primary()); err != nil || string(b) != "body" {
+		t.Errorf("primary read %q, error = %v, want body", b, err)
+	}
+	m.finishPrimary()
+}
@@ -0,0 +1,187 @@
+package shadow
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const dropReasonCircuitOpen = "circuit_open"
+
+// CircuitBreakerConfig pauses shadowing while the shadow handler is unhealthy. Once the share of shadowed requests
+// which fail or time out within a window passes FailureRatio, the breaker opens and requests are only handled by the
+// primary. After Cooldown, a single probe request is shadowed to decide whether to close the breaker again.
+type CircuitBreakerConfig struct {
+	FailureRatio float64 `json:"failure_ratio,omitempty"`
+	MinRequests  int     `json:"min_requests,omitempty"`
+	Window       string  `json:"window,omitempty"`
+	Cooldown     string  `json:"cooldown,omitempty"`
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return fmt.Sprintf("breakerState(%d)", int(s))
+}
+
+// breakerTicket identifies the state a breaker was in when it allowed a request. A request's outcome only counts
+// towards the state it was allowed in, so that stragglers from an earlier state can't decide the current one.
+type breakerTicket uint64
+
+type breaker struct {
+	mu sync.Mutex
+
+	state                 breakerState
+	generation            breakerTicket
+	windowStart, openedAt time.Time
+	requests, failures    int
+	timeouts              int
+	probing               bool
+	failureRatio          float64
+	minRequests           int
+	window, cooldown      time.Duration
+	now                   func() time.Time
+	onChange              func(from, to breakerState, requests, failures, timeouts int)
+}
+
+func newBreaker(cfg *CircuitBreakerConfig, now func() time.Time) (b *breaker, err error) {
+	b = &breaker{
+		failureRatio: 0.5,
+		minRequests:  20,
+		window:       30 * time.Second,
+		cooldown:     30 * time.Second,
+		now:          now,
+		onChange:     func(breakerState, breakerState, int, int, int) {},
+	}
+
+	if cfg.FailureRatio != 0 {
+		if cfg.FailureRatio < 0 || cfg.FailureRatio > 1 {
+			return nil, fmt.Errorf("failure_ratio must be between 0 and 1, got %v", cfg.FailureRatio)
+		}
+		b.failureRatio = cfg.FailureRatio
+	}
+	if cfg.MinRequests != 0 {
+		if cfg.MinRequests < 0 {
+			return nil, fmt.Errorf("min_requests must not be negative, got %d", cfg.MinRequests)
+		}
+		b.minRequests = cfg.MinRequests
+	}
+	if cfg.Window != "" {
+		b.window, err = time.ParseDuration(cfg.Window)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing window: %w", err)
+		}
+	}
+	if cfg.Cooldown != "" {
+		b.cooldown, err = time.ParseDuration(cfg.Cooldown)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing cooldown: %w", err)
+		}
+	}
+
+	b.windowStart = now()
+	return b, nil
+}
+
+// allow reports whether a request may be shadowed, and returns the ticket its outcome must be recorded with. While
+// half-open, only one probe request is allowed at a time.
+func (b *breaker) allow() (ticket breakerTicket, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return 0, false
+		}
+		b.transition(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return 0, false
+		}
+		b.probing = true
+	}
+
+	return b.generation, true
+}
+
+// record tracks the outcome of a shadowed request which was allowed by allow.
+func (b *breaker) record(ticket breakerTicket, failed, timedOut bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ticket != b.generation {
+		// Stragglers from before the breaker last changed state don't tell us anything new, and only the probe decides
+		// whether a half-open breaker closes
+		return
+	}
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed || timedOut {
+			b.transition(breakerOpen)
+		} else {
+			b.transition(breakerClosed)
+		}
+		return
+	}
+
+	if now := b.now(); now.Sub(b.windowStart) >= b.window {
+		b.windowStart = now
+		b.requests, b.failures, b.timeouts = 0, 0, 0
+	}
+
+	b.requests++
+	if timedOut {
+		b.timeouts++
+	} else if failed {
+		b.failures++
+	}
+
+	if b.requests >= b.minRequests &&
+		float64(b.failures+b.timeouts) >= b.failureRatio*float64(b.requests) {
+		b.transition(breakerOpen)
+	}
+}
+
+// abandon gives up on a shadowed request which was allowed by allow, without recording any outcome for it. If it was
+// the probe, a half-open breaker is then free to let another probe through.
+func (b *breaker) abandon(ticket breakerTicket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ticket == b.generation && b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// transition must be called while holding b.mu
+func (b *breaker) transition(to breakerState) {
+	from := b.state
+	b.state = to
+	b.generation++
+	b.onChange(from, to, b.requests, b.failures, b.timeouts)
+
+	switch to {
+	case breakerOpen:
+		b.openedAt = b.now()
+	case breakerClosed:
+		b.windowStart = b.now()
+		b.requests, b.failures, b.timeouts = 0, 0, 0
+	}
+}
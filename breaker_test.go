@@ -0,0 +1,133 @@
+package shadow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b, err := newBreaker(&CircuitBreakerConfig{
+		FailureRatio: 0.5,
+		MinRequests:  4,
+		Window:       "10s",
+		Cooldown:     "5s",
+	}, func() time.Time { return now })
+	if err != nil {
+		t.Fatalf("newBreaker() error = %v", err)
+	}
+
+	var transitions []breakerState
+	b.onChange = func(_, to breakerState, _, _, _ int) {
+		transitions = append(transitions, to)
+	}
+
+	// One failure and one timeout out of four requests reaches the failure ratio
+	for _, outcome := range []struct{ failed, timedOut bool }{{false, false}, {true, false}, {false, false}, {true, true}} {
+		ticket, ok := b.allow()
+		if !ok {
+			t.Fatalf("allow() = false while closed")
+		}
+		b.record(ticket, outcome.failed, outcome.timedOut)
+	}
+	if b.state != breakerOpen {
+		t.Fatalf("state = %v, want open", b.state)
+	}
+	if _, ok := b.allow(); ok {
+		t.Errorf("allow() = true while open")
+	}
+
+	// After the cooldown, exactly one probe is let through
+	now = now.Add(5 * time.Second)
+	probe, ok := b.allow()
+	if !ok {
+		t.Fatalf("allow() = false after cooldown, want a probe")
+	}
+	if _, ok := b.allow(); ok {
+		t.Errorf("allow() = true while a probe is in flight")
+	}
+	b.record(probe, true, false)
+	if b.state != breakerOpen {
+		t.Fatalf("state = %v after failed probe, want open", b.state)
+	}
+
+	now = now.Add(5 * time.Second)
+	probe, ok = b.allow()
+	if !ok {
+		t.Fatalf("allow() = false after cooldown, want a probe")
+	}
+	b.record(probe, false, false)
+	if b.state != breakerClosed {
+		t.Fatalf("state = %v after successful probe, want closed", b.state)
+	}
+
+	want := []breakerState{breakerOpen, breakerHalfOpen, breakerOpen, breakerHalfOpen, breakerClosed}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Errorf("transitions = %v, want %v", transitions, want)
+			break
+		}
+	}
+}
+
+func TestBreaker_window(t *testing.T) {
+	now := time.Unix(0, 0)
+	b, _ := newBreaker(&CircuitBreakerConfig{MinRequests: 2, Window: "10s"}, func() time.Time { return now })
+
+	b.record(0, true, false)
+	now = now.Add(10 * time.Second)
+	b.record(0, false, false)
+	b.record(0, false, false)
+	if b.state != breakerClosed {
+		t.Errorf("state = %v, want failures from an expired window to be forgotten", b.state)
+	}
+}
+
+func TestBreaker_abandon(t *testing.T) {
+	now := time.Unix(0, 0)
+	b, _ := newBreaker(&CircuitBreakerConfig{MinRequests: 1, Cooldown: "1s"}, func() time.Time { return now })
+
+	b.record(0, true, false)
+	now = now.Add(time.Second)
+	probe, ok := b.allow()
+	if !ok {
+		t.Fatalf("allow() = false after cooldown, want a probe")
+	}
+	b.abandon(probe)
+	if _, ok := b.allow(); !ok {
+		t.Errorf("allow() = false after the probe was abandoned, want another probe")
+	}
+}
+
+func TestBreaker_stragglers(t *testing.T) {
+	now := time.Unix(0, 0)
+	b, _ := newBreaker(&CircuitBreakerConfig{MinRequests: 1, Cooldown: "1s"}, func() time.Time { return now })
+
+	// Two requests are let through while closed, and the first to finish opens the breaker
+	first, _ := b.allow()
+	straggler, _ := b.allow()
+	b.record(first, true, false)
+	now = now.Add(time.Second)
+	probe, ok := b.allow()
+	if !ok {
+		t.Fatalf("allow() = false after cooldown, want a probe")
+	}
+
+	// The straggler finishes while the probe is in flight, and mustn't decide the half-open state
+	b.record(straggler, false, false)
+	if b.state != breakerHalfOpen {
+		t.Errorf("state = %v after a straggler succeeded, want half-open until the probe is done", b.state)
+	}
+	b.abandon(straggler)
+	if _, ok := b.allow(); ok {
+		t.Errorf("allow() = true after a straggler was abandoned, want the probe to still be in flight")
+	}
+
+	b.record(probe, false, false)
+	if b.state != breakerClosed {
+		t.Errorf("state = %v after the probe succeeded, want closed", b.state)
+	}
+}
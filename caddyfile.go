@@ -3,53 +3,67 @@ package shadow
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
 func init() {
 	caddy.RegisterModule(Handler{})
+	caddy.RegisterModule(adminAPI{})
 	httpcaddyfile.RegisterHandlerDirective("shadow", ParseCaddyfile)
 }
 
 func ParseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	hnd := new(Handler)
+	// defaults holds the options which can also be set on each named target
+	var defaults Target
 	h.Next()
 	for h.NextBlock(0) {
 		handlerName := h.Val()
 		switch handlerName {
-		case "primary", "shadow":
-			innerHnd, err := httpcaddyfile.ParseSegmentAsSubroute(h.WithDispenser(h.NewFromNextSegment()))
+		case "primary", "secondary", "shadow":
+			segment := h.NextSegment()
+			if handlerName == "shadow" && len(segment) > 1 && segment[1].Text != "{" {
+				target, err := parseTarget(h, segment)
+				if err != nil {
+					return nil, err
+				}
+				hnd.Targets = append(hnd.Targets, *target)
+				continue
+			}
+
+			innerHnd, err := httpcaddyfile.ParseSegmentAsSubroute(h.WithDispenser(caddyfile.NewDispenser(segment)))
 			if err != nil {
 				return nil, fmt.Errorf("error unmarshaling %s: %w", handlerName, err)
 			}
 
-			if handlerName == "primary" {
+			switch handlerName {
+			case "primary":
 				hnd.PrimaryRaw, err = json.Marshal(innerHnd)
 				if err != nil {
 					return nil, fmt.Errorf("error marshaling %s: %w", handlerName, err)
 				}
-			} else {
+			case "secondary":
+				hnd.SecondaryRaw, err = json.Marshal(innerHnd)
+				if err != nil {
+					return nil, fmt.Errorf("error marshaling %s: %w", handlerName, err)
+				}
+			default:
 				hnd.ShadowRaw, err = json.Marshal(innerHnd)
 				if err != nil {
 					return nil, fmt.Errorf("error marshaling %s: %w", handlerName, err)
 				}
 			}
-		case "compare_body":
-			hnd.ComparisonConfig.CompareBody = true
-		case "compare_status":
-			hnd.ComparisonConfig.CompareStatus = true
-		case "compare_headers":
-			hnd.ComparisonConfig.CompareHeaders = h.RemainingArgs()
-		case "compare_jq":
-			args := h.RemainingArgs()
-			if len(args) < 1 {
-				return nil, fmt.Errorf("compare_jq requires at least one jq query")
-			}
-			for _, qStr := range args {
-				hnd.ComparisonConfig.CompareJQ = append(hnd.ComparisonConfig.CompareJQ, JQQuery(qStr))
+		case "compare_body", "compare_body_hash", "compare_status", "compare_headers", "compare_jq", "compare_messages", "compare_events",
+			"sample_rate", "sample_key", "timeout", "shadow_timeout":
+			if err := parseTargetOption(&defaults, handlerName, h.RemainingArgs()); err != nil {
+				return nil, err
 			}
 		case "no_log":
 			hnd.ReportingConfig.NoLog = true
@@ -66,20 +80,358 @@ func ParseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				return nil, fmt.Errorf("metrics requires a prefix/namespace")
 			}
 			hnd.MetricsName = args[0]
-		case "timeout":
+		case "max_body_size":
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, fmt.Errorf("max_body_size requires a size")
+			}
+			hnd.MaxBodySize = args[0]
+			if len(args) > 1 {
+				hnd.LargeBody = args[1]
+			}
+		case "max_decoded_size":
+			if !h.NextArg() {
+				return nil, fmt.Errorf("max_decoded_size requires a size")
+			}
+			hnd.MaxDecodedSize = h.Val()
+		case "stream_primary":
+			hnd.StreamPrimary = true
+			if h.NextArg() {
+				hnd.CaptureLimit = h.Val()
+			}
+		case "shadow_header":
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, fmt.Errorf("shadow_header requires a header name")
+			}
+			hnd.ShadowHeader = args[0]
+			if len(args) > 1 {
+				hnd.ShadowHeaderValue = args[1]
+			}
+		case "request_id_header":
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, fmt.Errorf("request_id_header requires a header name")
+			}
+			hnd.RequestIDHeader = args[0]
+		case "detach_shadow":
+			hnd.DetachShadow = true
+		case "primary_timeout":
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, fmt.Errorf("primary_timeout requires duration")
+			}
+			hnd.PrimaryTimeout = args[0]
+		case "shadow_match":
+			matcherSet, err := caddyhttp.ParseCaddyfileNestedMatcherSet(h.Dispenser)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing shadow_match: %w", err)
+			}
+			hnd.ShadowMatchRaw = append(hnd.ShadowMatchRaw, matcherSet)
+		case "unsafe_methods":
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, fmt.Errorf("unsafe_methods requires a policy")
+			}
+			hnd.UnsafeMethods = args[0]
+		case "unsafe_match":
+			matcherSet, err := caddyhttp.ParseCaddyfileNestedMatcherSet(h.Dispenser)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing unsafe_match: %w", err)
+			}
+			hnd.UnsafeMatchRaw = append(hnd.UnsafeMatchRaw, matcherSet)
+		case "dry_run_header":
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, fmt.Errorf("dry_run_header requires a header name")
+			}
+			hnd.DryRunHeader = args[0]
+			if len(args) > 1 {
+				hnd.DryRunHeaderValue = args[1]
+			}
+		case "max_in_flight":
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, fmt.Errorf("max_in_flight requires a number of requests")
+			}
+			maxInFlight, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("error parsing max_in_flight: %w", err)
+			}
+			hnd.MaxInFlight = maxInFlight
+		case "max_rate":
+			args := h.RemainingArgs()
+			if len(args) < 1 {
+				return nil, fmt.Errorf("max_rate requires a rate, like 200/s")
+			}
+			hnd.MaxRate = args[0]
+		case "backoff":
+			hnd.Backoff = new(BackoffConfig)
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				option := h.Val()
+				args := h.RemainingArgs()
+				if len(args) < 1 {
+					return nil, fmt.Errorf("backoff %s requires a value", option)
+				}
+				switch option {
+				case "max_overhead":
+					hnd.Backoff.MaxOverhead = args[0]
+				case "max_memory":
+					hnd.Backoff.MaxMemory = args[0]
+				case "interval":
+					hnd.Backoff.Interval = args[0]
+				default:
+					return nil, fmt.Errorf("unknown backoff option: %s", option)
+				}
+			}
+		case "serve":
+			if !h.NextArg() {
+				return nil, fmt.Errorf("serve requires a mode")
+			}
+			hnd.Serve = h.Val()
+			if h.NextArg() {
+				hnd.ServeTarget = h.Val()
+			}
+			// The success rule is a response matcher, named after the last argument
+			name := h.Val()
+			matchers := make(map[string]caddyhttp.ResponseMatcher)
+			err := caddyhttp.ParseNamedResponseMatcher(h.NewFromNextSegment(), matchers)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing serve: %w", err)
+			}
+			if success := matchers[name]; success.StatusCode != nil || success.Headers != nil {
+				hnd.ServeSuccess = &success
+			}
+		case "verify":
+			hnd.Verify = new(VerifyConfig)
+			if h.NextArg() {
+				status, err := strconv.Atoi(h.Val())
+				if err != nil {
+					return nil, fmt.Errorf("error parsing verify status: %w", err)
+				}
+				hnd.Verify.Status = status
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch option := h.Val(); option {
+				case "status":
+					if !h.NextArg() {
+						return nil, fmt.Errorf("verify status requires a status code")
+					}
+					status, err := strconv.Atoi(h.Val())
+					if err != nil {
+						return nil, fmt.Errorf("error parsing verify status: %w", err)
+					}
+					hnd.Verify.Status = status
+				case "handler_error":
+					hnd.Verify.HandlerError = true
+				default:
+					return nil, fmt.Errorf("unknown verify option: %s", option)
+				}
+			}
+		case "debug_headers":
+			hnd.DebugHeaders = new(DebugHeadersConfig)
+			args := h.RemainingArgs()
+			switch len(args) {
+			case 0:
+			case 2:
+				hnd.DebugHeaders.Header, hnd.DebugHeaders.Value = args[0], args[1]
+			default:
+				return nil, fmt.Errorf("debug_headers takes a header name and secret value, or nothing")
+			}
+		case "diff_response":
+			args := h.RemainingArgs()
+			if len(args) != 2 {
+				return nil, fmt.Errorf("diff_response requires a header name and secret value")
+			}
+			hnd.DiffResponse = &DiffResponseConfig{Header: args[0], Value: args[1]}
+		case "route_key":
 			args := h.RemainingArgs()
 			if len(args) < 1 {
-				return nil, fmt.Errorf("timeout requires duration")
+				return nil, fmt.Errorf("route_key requires a placeholder")
+			}
+			hnd.RouteKey = strings.Join(args, " ")
+		case "ignore_fields":
+			args := h.RemainingArgs()
+			if len(args) < 2 {
+				return nil, fmt.Errorf("ignore_fields requires a route key and at least one field")
+			}
+			if hnd.IgnoreFields == nil {
+				hnd.IgnoreFields = make(map[string][]string)
+			}
+			hnd.IgnoreFields[args[0]] = append(hnd.IgnoreFields[args[0]], args[1:]...)
+		case "learn":
+			hnd.Learn = new(LearnConfig)
+			if h.NextArg() {
+				hnd.Learn.Name = h.Val()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				option := h.Val()
+				if option == "apply" {
+					hnd.Learn.Apply = true
+					continue
+				}
+				args := h.RemainingArgs()
+				if len(args) < 1 {
+					return nil, fmt.Errorf("learn %s requires a value", option)
+				}
+				var err error
+				switch option {
+				case "min_observations":
+					hnd.Learn.MinObservations, err = strconv.Atoi(args[0])
+				case "threshold":
+					hnd.Learn.Threshold, err = strconv.ParseFloat(args[0], 64)
+				case "max_routes":
+					hnd.Learn.MaxRoutes, err = strconv.Atoi(args[0])
+				default:
+					return nil, fmt.Errorf("unknown learn option: %s", option)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("error parsing learn %s: %w", option, err)
+				}
+			}
+		case "circuit_breaker":
+			hnd.CircuitBreaker = new(CircuitBreakerConfig)
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				option := h.Val()
+				args := h.RemainingArgs()
+				if len(args) < 1 {
+					return nil, fmt.Errorf("circuit_breaker %s requires a value", option)
+				}
+				var err error
+				switch option {
+				case "failure_ratio":
+					hnd.CircuitBreaker.FailureRatio, err = strconv.ParseFloat(args[0], 64)
+				case "min_requests":
+					hnd.CircuitBreaker.MinRequests, err = strconv.Atoi(args[0])
+				case "window":
+					hnd.CircuitBreaker.Window = args[0]
+				case "cooldown":
+					hnd.CircuitBreaker.Cooldown = args[0]
+				default:
+					return nil, fmt.Errorf("unknown circuit_breaker option: %s", option)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("error parsing circuit_breaker %s: %w", option, err)
+				}
 			}
-			hnd.Timeout = args[0]
 		}
 	}
 
+	hnd.ComparisonConfig = defaults.ComparisonConfig
+	hnd.SampleRate = defaults.SampleRate
+	hnd.SampleKey = defaults.SampleKey
+	hnd.ShadowTimeout = defaults.ShadowTimeout
+
 	if hnd.PrimaryRaw == nil {
 		return nil, fmt.Errorf("primary handler is required")
 	}
-	if hnd.ShadowRaw == nil {
+	if hnd.ShadowRaw == nil && len(hnd.Targets) == 0 {
 		return nil, fmt.Errorf("shadow handler is required")
 	}
 	return hnd, nil
 }
+
+// parseTarget parses a named target, `shadow <name> { ... }`. Target options are picked out of the block, and the
+// rest of it is parsed as the target's routes.
+func parseTarget(h httpcaddyfile.Helper, segment caddyfile.Segment) (*Target, error) {
+	d := caddyfile.NewDispenser(segment)
+	d.Next()
+	d.NextArg()
+	target := &Target{Name: d.Val()}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	// routes is the segment without the name and target options, since a subroute doesn't take any arguments
+	routes := caddyfile.Segment{segment[0]}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		line := d.NextSegment()
+		switch option {
+		case "compare_body", "compare_body_hash", "compare_status", "compare_headers", "compare_jq", "compare_messages", "compare_events",
+			"sample_rate", "sample_key", "timeout", "shadow_timeout":
+			args := make([]string, 0, len(line)-1)
+			for _, token := range line[1:] {
+				args = append(args, token.Text)
+			}
+			if err := parseTargetOption(target, option, args); err != nil {
+				return nil, fmt.Errorf("error parsing shadow %s: %w", target.Name, err)
+			}
+		default:
+			routes = append(routes, line...)
+		}
+	}
+	if len(segment) > 2 {
+		routes = slices.Insert(routes, 1, segment[2])
+		routes = append(routes, segment[len(segment)-1])
+	}
+
+	innerHnd, err := httpcaddyfile.ParseSegmentAsSubroute(h.WithDispenser(caddyfile.NewDispenser(routes)))
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling shadow %s: %w", target.Name, err)
+	}
+	target.ShadowRaw, err = json.Marshal(innerHnd)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling shadow %s: %w", target.Name, err)
+	}
+	return target, nil
+}
+
+// parseTargetOption parses an option which can be set on a named target, or on the handler as a default for every
+// target
+func parseTargetOption(target *Target, option string, args []string) error {
+	switch option {
+	case "compare_body":
+		target.ComparisonConfig.CompareBody = true
+	case "compare_body_hash":
+		target.ComparisonConfig.CompareBodyHash = bodyHashSHA256
+		if len(args) > 0 {
+			target.ComparisonConfig.CompareBodyHash = args[0]
+		}
+	case "compare_status":
+		target.ComparisonConfig.CompareStatus = true
+	case "compare_messages":
+		target.ComparisonConfig.CompareMessages = true
+	case "compare_events":
+		target.ComparisonConfig.CompareEvents = &EventsConfig{}
+		if len(args) > 0 {
+			maxEvents, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("error parsing compare_events: %w", err)
+			}
+			target.ComparisonConfig.CompareEvents.MaxEvents = maxEvents
+		}
+		if len(args) > 1 {
+			target.ComparisonConfig.CompareEvents.MaxDuration = args[1]
+		}
+	case "compare_headers":
+		target.ComparisonConfig.CompareHeaders = args
+	case "compare_jq":
+		if len(args) < 1 {
+			return fmt.Errorf("compare_jq requires at least one jq query")
+		}
+		for _, qStr := range args {
+			target.ComparisonConfig.CompareJQ = append(target.ComparisonConfig.CompareJQ, JQQuery(qStr))
+		}
+	case "sample_rate":
+		if len(args) < 1 {
+			return fmt.Errorf("sample_rate requires a rate between 0 and 1")
+		}
+		rate, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return fmt.Errorf("error parsing sample_rate: %w", err)
+		}
+		target.SampleRate = &rate
+	case "sample_key":
+		if len(args) < 1 {
+			return fmt.Errorf("sample_key requires a placeholder")
+		}
+		target.SampleKey = args[0]
+	case "timeout", "shadow_timeout":
+		if len(args) < 1 {
+			return fmt.Errorf("%s requires duration", option)
+		}
+		target.ShadowTimeout = args[0]
+	}
+	return nil
+}
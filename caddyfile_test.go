@@ -0,0 +1,361 @@
+package shadow
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	_ "github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+// adaptShadow adapts a Caddyfile site block and returns the first shadow handler from the resulting JSON config
+func adaptShadow(t *testing.T, directive string) Handler {
+	t.Helper()
+
+	input := "{\n\torder shadow first\n}\nhttp://localhost:8080 {\n" + directive + "\n}"
+	adapted, warnings, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("error adapting Caddyfile: %v", err)
+	}
+	if len(warnings) > 0 {
+		t.Logf("warnings: %v", warnings)
+	}
+
+	var cfg any
+	if err = json.Unmarshal(adapted, &cfg); err != nil {
+		t.Fatalf("error unmarshaling adapted config: %v", err)
+	}
+
+	if raw := findShadow(cfg); raw != nil {
+		var h Handler
+		if err = json.Unmarshal(raw, &h); err != nil {
+			t.Fatalf("error unmarshaling shadow handler: %v", err)
+		}
+		return h
+	}
+
+	t.Fatalf("no shadow handler in adapted config: %s", adapted)
+	return Handler{}
+}
+
+// findShadow walks the adapted config looking for the JSON of the shadow handler
+func findShadow(v any) json.RawMessage {
+	switch v := v.(type) {
+	case map[string]any:
+		if v["handler"] == "shadow" {
+			raw, _ := json.Marshal(v)
+			return raw
+		}
+		for _, child := range v {
+			if raw := findShadow(child); raw != nil {
+				return raw
+			}
+		}
+	case []any:
+		for _, child := range v {
+			if raw := findShadow(child); raw != nil {
+				return raw
+			}
+		}
+	}
+	return nil
+}
+
+func TestParseCaddyfile(t *testing.T) {
+	h := adaptShadow(t, `shadow {
+		sample_rate 0.05
+		sample_key {http.request.header.X-User-ID}
+		unsafe_methods dry_run
+		unsafe_match {
+			path /search
+		}
+		dry_run_header X-Read-Only true
+		max_in_flight 100
+		shadow_timeout 5s
+		shadow_header X-Shadow-Request yes
+		request_id_header X-Request-ID
+		primary_timeout 1m
+		max_rate 200/s
+		backoff {
+			max_overhead 5ms
+			max_memory 512MiB
+		}
+		circuit_breaker {
+			failure_ratio 0.25
+			cooldown 1m
+		}
+		shadow_match {
+			path /api/*
+			method GET
+		}
+		primary {
+			respond "primary"
+		}
+		secondary {
+			respond "secondary"
+		}
+		shadow {
+			respond "shadow"
+		}
+	}`)
+
+	if h.SampleRate == nil || *h.SampleRate != 0.05 {
+		t.Errorf("SampleRate = %v, want 0.05", h.SampleRate)
+	}
+	if h.SampleKey != "{http.request.header.X-User-ID}" {
+		t.Errorf("SampleKey = %q, want {http.request.header.X-User-ID}", h.SampleKey)
+	}
+	if h.ShadowTimeout != "5s" || h.PrimaryTimeout != "1m" {
+		t.Errorf("ShadowTimeout = %q, PrimaryTimeout = %q, want 5s and 1m", h.ShadowTimeout, h.PrimaryTimeout)
+	}
+	if h.ShadowHeader != "X-Shadow-Request" || h.ShadowHeaderValue != "yes" || h.RequestIDHeader != "X-Request-ID" {
+		t.Errorf("ShadowHeader = %q: %q, RequestIDHeader = %q", h.ShadowHeader, h.ShadowHeaderValue, h.RequestIDHeader)
+	}
+	if h.UnsafeMethods != unsafeMethodsDryRun || len(h.UnsafeMatchRaw) != 1 {
+		t.Errorf("UnsafeMethods = %q, UnsafeMatchRaw = %v, want dry_run with one matcher set", h.UnsafeMethods, h.UnsafeMatchRaw)
+	}
+	if h.DryRunHeader != "X-Read-Only" || h.DryRunHeaderValue != "true" {
+		t.Errorf("DryRunHeader = %q: %q, want X-Read-Only: true", h.DryRunHeader, h.DryRunHeaderValue)
+	}
+	if h.MaxInFlight != 100 {
+		t.Errorf("MaxInFlight = %d, want 100", h.MaxInFlight)
+	}
+	if h.MaxRate != "200/s" {
+		t.Errorf("MaxRate = %q, want 200/s", h.MaxRate)
+	}
+	if h.CircuitBreaker == nil || h.CircuitBreaker.FailureRatio != 0.25 || h.CircuitBreaker.Cooldown != "1m" {
+		t.Errorf("CircuitBreaker = %+v, want failure_ratio 0.25 and cooldown 1m", h.CircuitBreaker)
+	}
+	if h.Backoff == nil || h.Backoff.MaxOverhead != "5ms" || h.Backoff.MaxMemory != "512MiB" {
+		t.Errorf("Backoff = %+v, want max_overhead 5ms and max_memory 512MiB", h.Backoff)
+	}
+	if len(h.ShadowMatchRaw) != 1 || len(h.ShadowMatchRaw[0]) != 2 {
+		t.Errorf("ShadowMatchRaw = %v, want one set with path and method matchers", h.ShadowMatchRaw)
+	}
+	if h.PrimaryRaw == nil || h.SecondaryRaw == nil || h.ShadowRaw == nil {
+		t.Errorf("primary, secondary and shadow handlers should all be set")
+	}
+}
+
+func TestParseCaddyfile_compareBodyHash(t *testing.T) {
+	h := adaptShadow(t, `shadow {
+		compare_body_hash
+		primary {
+			respond "primary"
+		}
+		shadow fast {
+			compare_body_hash xxhash
+			respond "fast"
+		}
+	}`)
+	if h.CompareBodyHash != bodyHashSHA256 {
+		t.Errorf("CompareBodyHash = %q, want sha256 by default", h.CompareBodyHash)
+	}
+	if len(h.Targets) != 1 || h.Targets[0].CompareBodyHash != bodyHashXXHash {
+		t.Errorf("Targets = %+v, want fast to compare by xxhash", h.Targets)
+	}
+}
+
+func TestParseCaddyfile_streamPrimary(t *testing.T) {
+	h := adaptShadow(t, `shadow {
+		stream_primary 64KiB
+		primary {
+			respond "primary"
+		}
+		shadow {
+			respond "shadow"
+		}
+	}`)
+	if !h.StreamPrimary || h.CaptureLimit != "64KiB" {
+		t.Errorf("StreamPrimary = %v, CaptureLimit = %q, want streaming with a 64KiB capture limit", h.StreamPrimary, h.CaptureLimit)
+	}
+}
+
+func TestParseCaddyfile_compareMessages(t *testing.T) {
+	h := adaptShadow(t, `shadow {
+		compare_body
+		primary {
+			respond "primary"
+		}
+		shadow realtime {
+			compare_messages
+			respond "realtime"
+		}
+	}`)
+	if !h.CompareBody || h.CompareMessages {
+		t.Errorf("ComparisonConfig = %+v, want only compare_body", h.ComparisonConfig)
+	}
+	if len(h.Targets) != 1 || !h.Targets[0].CompareMessages {
+		t.Errorf("Targets = %+v, want realtime to compare messages", h.Targets)
+	}
+}
+
+func TestParseCaddyfile_compareEvents(t *testing.T) {
+	h := adaptShadow(t, `shadow {
+		compare_events
+		primary {
+			respond "primary"
+		}
+		shadow feed {
+			compare_events 5 2s
+			respond "feed"
+		}
+	}`)
+	if h.CompareEvents == nil || h.CompareEvents.MaxEvents != 0 || h.CompareEvents.MaxDuration != "" {
+		t.Errorf("CompareEvents = %+v, want the defaults", h.CompareEvents)
+	}
+	if len(h.Targets) != 1 || h.Targets[0].CompareEvents == nil ||
+		h.Targets[0].CompareEvents.MaxEvents != 5 || h.Targets[0].CompareEvents.MaxDuration != "2s" {
+		t.Errorf("Targets = %+v, want feed to compare 5 events for up to 2s", h.Targets)
+	}
+}
+
+func TestParseCaddyfile_targets(t *testing.T) {
+	h := adaptShadow(t, `shadow {
+		sample_rate 0.5
+		compare_status
+		primary {
+			respond "primary"
+		}
+		shadow rewrite {
+			sample_rate 0.01
+			shadow_timeout 2s
+			compare_body
+			respond "rewrite"
+		}
+		shadow schema {
+			respond "schema"
+		}
+	}`)
+
+	if h.ShadowRaw != nil {
+		t.Errorf("ShadowRaw = %s, want only named targets", h.ShadowRaw)
+	}
+	if h.SampleRate == nil || *h.SampleRate != 0.5 || !h.CompareStatus {
+		t.Errorf("SampleRate = %v, CompareStatus = %v, want handler defaults of 0.5 and true", h.SampleRate, h.CompareStatus)
+	}
+	if len(h.Targets) != 2 {
+		t.Fatalf("Targets = %+v, want rewrite and schema", h.Targets)
+	}
+
+	rewrite, schema := h.Targets[0], h.Targets[1]
+	if rewrite.Name != "rewrite" || schema.Name != "schema" {
+		t.Errorf("target names = %q, %q, want rewrite and schema", rewrite.Name, schema.Name)
+	}
+	if rewrite.SampleRate == nil || *rewrite.SampleRate != 0.01 || rewrite.ShadowTimeout != "2s" || !rewrite.CompareBody {
+		t.Errorf("rewrite = %+v, want sample_rate 0.01, shadow_timeout 2s and compare_body", rewrite)
+	}
+	if schema.SampleRate != nil || schema.ShadowTimeout != "" || schema.CompareBody {
+		t.Errorf("schema = %+v, want everything inherited", schema)
+	}
+	for _, target := range h.Targets {
+		var routes map[string]any
+		if err := json.Unmarshal(target.ShadowRaw, &routes); err != nil || routes["routes"] == nil {
+			t.Errorf("target %s routes = %s, error = %v", target.Name, target.ShadowRaw, err)
+		}
+	}
+}
+
+func TestParseCaddyfile_learn(t *testing.T) {
+	h := adaptShadow(t, `shadow {
+		route_key {http.request.method} {http.request.uri.path}
+		ignore_fields * body/timestamp
+		ignore_fields /users body/id body/etag
+		learn users {
+			min_observations 50
+			threshold 0.9
+			apply
+		}
+		primary {
+			respond "primary"
+		}
+		shadow {
+			respond "shadow"
+		}
+	}`)
+
+	if h.RouteKey != defaultRouteKey {
+		t.Errorf("RouteKey = %q, want %q", h.RouteKey, defaultRouteKey)
+	}
+	if len(h.IgnoreFields["*"]) != 1 || len(h.IgnoreFields["/users"]) != 2 {
+		t.Errorf("IgnoreFields = %v, want one field for every route and two for /users", h.IgnoreFields)
+	}
+	if h.Learn == nil || h.Learn.Name != "users" || h.Learn.MinObservations != 50 || h.Learn.Threshold != 0.9 || !h.Learn.Apply {
+		t.Errorf("Learn = %+v, want users with min_observations 50, threshold 0.9 and apply", h.Learn)
+	}
+}
+
+func TestParseCaddyfile_serve(t *testing.T) {
+	h := adaptShadow(t, `shadow {
+		serve shadow_with_fallback rewrite {
+			status 2xx 304
+			header Content-Type application/json*
+		}
+		primary {
+			respond "primary"
+		}
+		shadow rewrite {
+			respond "rewrite"
+		}
+	}`)
+
+	if h.Serve != serveShadowWithFallback || h.ServeTarget != "rewrite" {
+		t.Errorf("Serve = %q, ServeTarget = %q, want shadow_with_fallback and rewrite", h.Serve, h.ServeTarget)
+	}
+	if h.ServeSuccess == nil || !slices.Equal(h.ServeSuccess.StatusCode, []int{2, 304}) || h.ServeSuccess.Headers.Get("Content-Type") == "" {
+		t.Errorf("ServeSuccess = %+v, want status 2xx and 304 with a Content-Type header", h.ServeSuccess)
+	}
+
+	h = adaptShadow(t, `shadow {
+		serve race
+		primary {
+			respond "primary"
+		}
+		shadow {
+			respond "shadow"
+		}
+	}`)
+	if h.Serve != serveRace || h.ServeTarget != "" || h.ServeSuccess != nil {
+		t.Errorf("Serve = %q, ServeTarget = %q, ServeSuccess = %+v, want race with the defaults", h.Serve, h.ServeTarget, h.ServeSuccess)
+	}
+}
+
+func TestParseCaddyfile_blocking(t *testing.T) {
+	h := adaptShadow(t, `shadow {
+		verify 409
+		debug_headers X-Shadow-Debug s3cret
+		diff_response X-Shadow-Diff t0ken
+		primary {
+			respond "primary"
+		}
+		shadow {
+			respond "shadow"
+		}
+	}`)
+	if h.Verify == nil || h.Verify.Status != 409 || h.Verify.HandlerError {
+		t.Errorf("Verify = %+v, want status 409", h.Verify)
+	}
+	if h.DebugHeaders == nil || h.DebugHeaders.Header != "X-Shadow-Debug" || h.DebugHeaders.Value != "s3cret" {
+		t.Errorf("DebugHeaders = %+v, want X-Shadow-Debug: s3cret", h.DebugHeaders)
+	}
+	if h.DiffResponse == nil || h.DiffResponse.Header != "X-Shadow-Diff" || h.DiffResponse.Value != "t0ken" {
+		t.Errorf("DiffResponse = %+v, want X-Shadow-Diff: t0ken", h.DiffResponse)
+	}
+
+	h = adaptShadow(t, `shadow {
+		verify {
+			status 422
+			handler_error
+		}
+		primary {
+			respond "primary"
+		}
+		shadow {
+			respond "shadow"
+		}
+	}`)
+	if h.Verify == nil || h.Verify.Status != 422 || !h.Verify.HandlerError {
+		t.Errorf("Verify = %+v, want status 422 as a handler error", h.Verify)
+	}
+}
@@ -1,10 +1,10 @@
 package shadow
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"maps"
 	"net/http"
 	"slices"
 
@@ -34,6 +34,17 @@ type ComparisonConfig struct {
 	CompareHeaders []string  `json:"compare_headers,omitempty"`
 	CompareJQ      []JQQuery `json:"compare_jq,omitempty"`
 	compareJQ      []*gojq.Query
+
+	// CompareBodyHash compares response bodies by their "sha256" or "xxhash" digest and length, hashed as they're
+	// written rather than buffered, so memory use doesn't grow with the size of the responses.
+	CompareBodyHash string `json:"compare_body_hash,omitempty"`
+
+	// CompareEvents compares text/event-stream responses event by event, instead of by their body.
+	CompareEvents *EventsConfig `json:"compare_events,omitempty"`
+
+	// CompareMessages compares the messages each side sends in a mirrored WebSocket session, in order, by their SHA-256
+	// digest and length.
+	CompareMessages bool `json:"compare_messages,omitempty"`
 }
 
 type ReportingConfig struct {
@@ -41,127 +52,320 @@ type ReportingConfig struct {
 	LogLevel *LogLevel `json:"log_level,omitempty"`
 }
 
-func (h *Handler) compareStatus(primaryStatus, shadowStatus int) {
-	if primaryStatus != shadowStatus {
-		h.slogger.Info("shadow_status_mismatch",
-			slog.Int("primary_status", primaryStatus),
-			slog.Int("shadow_status", shadowStatus),
-		)
+// provision parses the jq queries
+func (c *ComparisonConfig) provision() (err error) {
+	switch c.CompareBodyHash {
+	case "", bodyHashSHA256, bodyHashXXHash:
+	default:
+		return fmt.Errorf("compare_body_hash must be %q or %q, got %q", bodyHashSHA256, bodyHashXXHash, c.CompareBodyHash)
+	}
+	if c.CompareBodyHash != "" && len(c.CompareJQ) > 0 {
+		return fmt.Errorf("compare_body_hash can't be combined with compare_jq, which needs the whole body")
+	}
+
+	if c.CompareEvents != nil {
+		if err = c.CompareEvents.provision(); err != nil {
+			return fmt.Errorf("error provisioning compare_events: %w", err)
+		}
+	}
+
+	if len(c.CompareJQ) > 0 {
+		c.compareJQ = make([]*gojq.Query, len(c.CompareJQ))
+		for i, qStr := range c.CompareJQ {
+			c.compareJQ[i], err = gojq.Parse(string(qStr))
+			if err != nil {
+				return fmt.Errorf("error parsing jq query %d: %w", i, err)
+			}
+		}
 	}
+	return nil
 }
 
-func (h *Handler) compareHeaders(primaryH, shadowH http.Header) {
-	for _, k := range h.CompareHeaders {
-		ph, sh := primaryH.Values(k), shadowH.Values(k)
-		if slices.Equal(ph, sh) {
-			h.slogger.Info(
-				"shadow_header_mismatch",
-				slog.String("key", k),
-				slog.Any("primary_values", ph),
-				slog.Any("shadow_values", sh),
-			)
+// comparison is the result of comparing a target's response with the primary's. The logs and metrics, verify, debug
+// headers and diffs all go by the same result, so they can't disagree.
+type comparison struct {
+	// skipped explains why the responses weren't compared at all, and err is the error the target failed with
+	skipped string
+	err     error
+
+	primary, shadow response
+
+	// bodyDiffs are the body's fields which differ, when bodyCompared. Every field which differs is either ignored,
+	// learned as noise, or a regression.
+	bodyCompared bool
+	bodyDiffs    []string
+	regressions  []string
+	ignored      []string
+	noise        []string
+}
+
+// match reports whether the responses were compared, and the target's can't be told apart from the primary's
+func (c comparison) match() bool {
+	return c.skipped == "" && c.err == nil && len(c.regressions) == 0
+}
+
+// bodyFields returns the fields which are the body's
+func (c comparison) bodyFields(fields []string) (body []string) {
+	for _, field := range fields {
+		if slices.Contains(c.bodyDiffs, field) {
+			body = append(body, field)
 		}
 	}
+	return body
+}
+
+// comparesBody reports whether response bodies are compared, in full, by hash or with jq queries
+func (c *ComparisonConfig) comparesBody() bool {
+	return c.CompareBody || c.CompareBodyHash != "" || len(c.compareJQ) > 0
 }
 
-func (h *Handler) compareBody(primaryBS, shadowBS []byte) {
-	var match bool
-	if h.CompareJQ != nil {
-		match = h.compareJSON(primaryBS, shadowBS)
-	} else {
-		match = slices.Equal(primaryBS, shadowBS)
+// compareResponses compares a target's decoded response with the primary's. Differences in ignored fields, or in
+// fields learned as noise from the secondary, aren't regressions. Event stream bodies are left to be compared event by
+// event, as they're sent.
+func (h *Handler) compareResponses(t *target, route string, primary, shadow response) comparison {
+	c := comparison{
+		primary:      primary,
+		shadow:       shadow,
+		bodyCompared: t.comparesBody() && (t.CompareEvents == nil || !isEventStream(primary.header)),
 	}
 
-	if h.MetricsName != "" {
-		if match {
-			h.metrics.match.Inc()
-		} else {
-			h.metrics.mismatch.Inc()
+	var diffs []string
+	if c.bodyCompared {
+		c.bodyDiffs = t.responseBodyDiffs(primary, shadow)
+		diffs = slices.Clone(c.bodyDiffs)
+	}
+	for _, k := range t.CompareHeaders {
+		if !slices.Equal(primary.header.Values(k), shadow.header.Values(k)) {
+			diffs = append(diffs, headerField(k))
 		}
 	}
+	if t.CompareStatus && primary.status != shadow.status {
+		diffs = append(diffs, statusField)
+	}
 
-	if match { // If we've matched, nothing left to do
+	diffs, c.ignored = h.splitIgnored(route, diffs)
+	c.regressions, c.noise = h.noise.split(route, diffs)
+	return c
+}
+
+// report logs and counts a comparison, and has the learner observe the body's differences
+func (h *Handler) report(t *target, route string, c comparison) {
+	if c.bodyCompared {
+		h.observe(route, c.bodyDiffs)
+		h.reportBody(t, c)
+	}
+	h.reportHeaders(t, c)
+	h.reportStatus(t, c)
+}
+
+// observe has the learner observe the fields which differ for the route, and logs the ignore rules it proposes
+func (h *Handler) observe(route string, diffs []string) {
+	if h.learner == nil {
 		return
 	}
 
-	if !h.NoLog {
-		h.slogger.Info("shadow_mismatch",
-			"primary_body", string(primaryBS),
-			"shadow_body", string(shadowBS),
+	proposed, dropped := h.learner.observe(route, diffs)
+	for _, field := range proposed {
+		h.slogger.Info("shadow_ignore_proposed",
+			slog.String("route", route),
+			slog.String("field", field),
+			slog.Bool("applied", h.Learn.Apply),
+		)
+	}
+	if dropped > 0 {
+		if h.MetricsName != "" {
+			h.metrics.learnDropped.Inc()
+		}
+		// Only the first is a warning, as once the routes are full every comparison for a new route is dropped
+		level := slog.LevelDebug
+		if dropped == 1 {
+			level = slog.LevelWarn
+		}
+		h.slogger.Log(context.Background(), level, "shadow_learn_route_dropped",
+			slog.String("route", route),
+			slog.Int("dropped", dropped),
 		)
 	}
 }
 
-func (h *Handler) compareJSON(primaryBS, shadowBS []byte) bool {
-	for _, jq := range h.compareJQ {
-		var primary, shadow any
-		_ = json.Unmarshal(primaryBS, &primary)
-		_ = json.Unmarshal(shadowBS, &shadow)
+func (h *Handler) reportStatus(t *target, c comparison) {
+	msg, level := "shadow_status_mismatch", slog.LevelInfo
+	switch {
+	case slices.Contains(c.regressions, statusField):
+	case slices.Contains(c.noise, statusField):
+		msg, level = "shadow_status_noise", slog.LevelDebug
+	default:
+		return
+	}
+
+	h.slogger.Log(context.Background(), level, msg,
+		slog.String("target", t.name),
+		slog.Int("primary_status", c.primary.status),
+		slog.Int("shadow_status", c.shadow.status),
+	)
+}
 
-		pi, si := jq.Run(primary), jq.Run(shadow)
-		// These iterators should never be nil but just to be safe...
-		// If both iterators are nil, something is REALLY unexpected, but *technically* that's a match
-		if pi == nil && si == nil {
+func (h *Handler) reportHeaders(t *target, c comparison) {
+	for _, k := range t.CompareHeaders {
+		msg, level := "shadow_header_mismatch", slog.LevelInfo
+		switch field := headerField(k); {
+		case slices.Contains(c.regressions, field):
+		case slices.Contains(c.noise, field):
+			msg, level = "shadow_header_noise", slog.LevelDebug
+		default:
 			continue
 		}
-		// If only one iterator is nil, something is REALLY unexpected, but *technically* that's a mismatch
-		if (pi == nil) != (si == nil) {
+
+		h.slogger.Log(context.Background(), level, msg,
+			slog.String("target", t.name),
+			slog.String("key", k),
+			slog.Any("primary_values", c.primary.header.Values(k)),
+			slog.Any("shadow_values", c.shadow.header.Values(k)),
+		)
+	}
+}
+
+func (h *Handler) reportBody(t *target, c comparison) {
+	regressions, noisy := c.bodyFields(c.regressions), c.bodyFields(c.noise)
+	if h.MetricsName != "" {
+		switch {
+		case len(regressions) > 0:
+			t.metrics.mismatch.Inc()
+		case len(noisy) > 0:
+			t.metrics.noise.Inc()
+		default:
+			t.metrics.match.Inc()
+		}
+	}
+
+	if h.NoLog {
+		return
+	}
+
+	if len(regressions) == 0 {
+		if len(noisy) > 0 {
+			h.slogger.Debug("shadow_noise",
+				"target", t.name,
+				"noise", noisy,
+			)
+		}
+		return
+	}
+
+	attrs := []any{
+		"target", t.name,
+		"primary_body", string(c.primary.body),
+		"shadow_body", string(c.shadow.body),
+	}
+	if algorithm := t.bodyHash(c.primary); algorithm != "" {
+		primaryDigest, shadowDigest := c.primary.bodyDigest(algorithm), c.shadow.bodyDigest(algorithm)
+		attrs = []any{
+			"target", t.name,
+			"primary_body_" + algorithm, primaryDigest.String(),
+			"primary_body_size", primaryDigest.size,
+			"shadow_body_" + algorithm, shadowDigest.String(),
+			"shadow_body_size", shadowDigest.size,
+		}
+	}
+	if h.noise != nil {
+		attrs = append(attrs, "regressions", regressions, "noise", noisy)
+	}
+	if ignored := c.bodyFields(c.ignored); len(ignored) > 0 {
+		attrs = append(attrs, "ignored", ignored)
+	}
+	h.slogger.Info("shadow_mismatch", attrs...)
+}
+
+func (c *ComparisonConfig) compareJSON(primaryBS, shadowBS []byte) bool {
+	var primary, shadow any
+	_ = json.Unmarshal(primaryBS, &primary)
+	_ = json.Unmarshal(shadowBS, &shadow)
+
+	for _, jq := range c.compareJQ {
+		if !jqEqual(jq, primary, shadow) {
 			return false
 		}
+	}
 
-		for {
-			pn, pok := pi.Next()
-			sn, sok := si.Next()
-			if sok != pok {
-				// If the iterators have a different result length, that's a mismatch
-				return false
-			}
-			if !pok {
-				break
-			}
+	return true
+}
 
-			switch pn.(type) {
-			case map[string]any:
-				pm := pn.(map[string]any)
-				sm, ok := sn.(map[string]any)
-				if !ok {
-					return false
-				}
-
-				if !maps.Equal(pm, sm) {
-					return false
-				}
-			case []any:
-				psl := pn.([]any)
-				ssl, ok := sn.([]any)
-				if !ok {
-					return false
-				}
-
-				if !slices.Equal(psl, ssl) {
-					return false
-				}
-			default:
-				if pn != sn {
-					return false
-				}
-			}
+// jqEqual reports whether a jq query selects the same results from both decoded responses
+func jqEqual(jq *gojq.Query, primary, shadow any) bool {
+	pi, si := jq.Run(primary), jq.Run(shadow)
+	// These iterators should never be nil but just to be safe...
+	// If both iterators are nil, something is REALLY unexpected, but *technically* that's a match
+	if pi == nil && si == nil {
+		return true
+	}
+	// If only one iterator is nil, something is REALLY unexpected, but *technically* that's a mismatch
+	if (pi == nil) != (si == nil) {
+		return false
+	}
+
+	for {
+		pn, pok := pi.Next()
+		sn, sok := si.Next()
+		if sok != pok {
+			// If the iterators have a different result length, that's a mismatch
+			return false
+		}
+		if !pok {
+			break
+		}
+
+		if !jqResultEqual(pn, sn) {
+			return false
 		}
 	}
 
 	return true
 }
 
-func (h *Handler) shouldBuffer(status int, hdr http.Header) bool {
+// jqResultEqual compares two results of a jq query by jq's own rules, so nested objects and arrays are compared in full
+// and 1 equals 1.0. Errors, which jq can't compare, are equal when their messages are.
+func jqResultEqual(primary, shadow any) bool {
+	primaryErr, pok := primary.(error)
+	shadowErr, sok := shadow.(error)
+	if pok || sok {
+		return pok && sok && primaryErr.Error() == shadowErr.Error()
+	}
+	return gojq.Compare(primary, shadow) == 0
+}
+
+// bodyHash returns the algorithm the primary's body and a target's are compared by, or "" if they're compared in full.
+// A primary's body which was too large to capture is compared by SHA-256, unless the target compares by another.
+func (c *ComparisonConfig) bodyHash(primary response) string {
+	if c.CompareBodyHash == "" && primary.hashOnly {
+		return bodyHashSHA256
+	}
+	return c.CompareBodyHash
+}
+
+// shouldBuffer reports whether a response should be buffered for comparison. Bodies compared by hash never are.
+func (c *ComparisonConfig) shouldBuffer(status int, hdr http.Header) bool {
+	return c.shouldCompare() && c.CompareBodyHash == "" && shouldBufferResponse(status, hdr) &&
+		(c.CompareEvents == nil || !isEventStream(hdr))
+}
+
+// shouldBufferResponse reports whether a response is one we're able to compare. Compressed responses are buffered as
+// they are, and only decoded for comparison.
+func shouldBufferResponse(status int, hdr http.Header) bool {
 	return status >= 200 &&
 		status < 300 &&
-		h.shouldCompare() &&
-		hdr.Get("Content-Encoding") == ""
+		decodable(hdr)
+}
+
+// hasComparisons reports whether any comparison is configured, including those of event streams and WebSocket
+// sessions, which aren't compared as responses
+func (c *ComparisonConfig) hasComparisons() bool {
+	return c.shouldCompare() || c.CompareEvents != nil || c.CompareMessages
 }
 
-func (h *Handler) shouldCompare() bool {
-	return h.CompareBody ||
-		len(h.compareJQ) > 0 ||
-		h.CompareStatus ||
-		len(h.CompareHeaders) > 0
+func (c *ComparisonConfig) shouldCompare() bool {
+	return c.CompareBody ||
+		c.CompareBodyHash != "" ||
+		len(c.compareJQ) > 0 ||
+		c.CompareStatus ||
+		len(c.CompareHeaders) > 0
 }
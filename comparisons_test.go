@@ -2,7 +2,9 @@ package shadow
 
 import (
 	"github.com/itchyny/gojq"
+	"log/slog"
 	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -101,6 +103,21 @@ func TestHandler_shouldBuffer(t *testing.T) {
 					"Content-Encoding": []string{"gzip"},
 				},
 			},
+			want: true,
+		},
+		{
+			name: "unsupported encoding",
+			fields: fields{
+				ComparisonConfig: ComparisonConfig{
+					CompareBody: true,
+				},
+			},
+			args: args{
+				status: 200,
+				headers: http.Header{
+					"Content-Encoding": []string{"compress"},
+				},
+			},
 			want: false,
 		},
 		{
@@ -352,3 +369,73 @@ func TestHandler_compareJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestJQEqual_nested(t *testing.T) {
+	// Nested objects and arrays used to be compared with == and panicked, taking the comparison's goroutine, and
+	// Caddy, down with them
+	tests := []struct {
+		name    string
+		query   string
+		primary string
+		shadow  string
+		want    bool
+	}{
+		{name: "same nested object", query: ".", primary: `{"a":{"b":{"c":1}}}`, shadow: `{"a":{"b":{"c":1}}}`, want: true},
+		{name: "different nested object", query: ".", primary: `{"a":{"b":{"c":1}}}`, shadow: `{"a":{"b":{"c":2}}}`},
+		{name: "same nested array", query: ".a", primary: `{"a":[[1,2],[3]]}`, shadow: `{"a":[[1,2],[3]]}`, want: true},
+		{name: "different nested array", query: ".a", primary: `{"a":[[1,2],[3]]}`, shadow: `{"a":[[1,2],[4]]}`},
+		{name: "same objects in an array", query: ".items", primary: `{"items":[{"id":1,"tags":["x"]}]}`, shadow: `{"items":[{"tags":["x"],"id":1}]}`, want: true},
+		{name: "different objects in an array", query: ".items", primary: `{"items":[{"id":1,"tags":["x"]}]}`, shadow: `{"items":[{"id":1,"tags":["y"]}]}`},
+		{name: "same errors", query: ".a.b", primary: `{"a":[]}`, shadow: `{"a":[]}`, want: true},
+		{name: "error and null", query: ".a.b", primary: `{"a":[]}`, shadow: `{"a":{}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := gojq.Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := ComparisonConfig{CompareJQ: []JQQuery{JQQuery(tt.query)}, compareJQ: []*gojq.Query{q}}
+
+			if got := c.compareJSON([]byte(tt.primary), []byte(tt.shadow)); got != tt.want {
+				t.Errorf("compareJSON() = %v, want %v", got, tt.want)
+			}
+			if got := len(c.bodyDiffs([]byte(tt.primary), []byte(tt.shadow))) == 0; got != tt.want {
+				t.Errorf("bodyDiffs() match = %v, want %v", got, tt.want)
+			}
+			primary, shadow := serverSentEvent{Data: tt.primary}, serverSentEvent{Data: tt.shadow}
+			if got := c.eventEqual(primary, shadow); got != tt.want {
+				t.Errorf("eventEqual() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_compareHeaders_onlyDiffering(t *testing.T) {
+	// Headers which are the same on both sides used to be logged as a mismatch, and those which differed weren't
+	logs := make(logWriter, 10)
+	h := &Handler{slogger: slog.New(slog.NewTextHandler(logs, nil))}
+	tg := &target{name: "shadow", ComparisonConfig: ComparisonConfig{CompareHeaders: []string{"Content-Type", "Server", "X-Missing"}}}
+
+	compareAndReport(h, tg, "GET /",
+		response{header: http.Header{"Content-Type": {"text/plain"}, "Server": {"caddy"}}},
+		response{header: http.Header{"Content-Type": {"text/html"}, "Server": {"caddy"}}},
+	)
+	close(logs)
+
+	var got []string
+	for line := range logs {
+		got = append(got, line)
+	}
+	if len(got) != 1 || !strings.Contains(got[0], "msg=shadow_header_mismatch") || !strings.Contains(got[0], "key=Content-Type") {
+		t.Errorf("reportHeaders() should only report Content-Type as a mismatch, logged %v", got)
+	}
+}
+
+// compareAndReport compares two decoded responses and reports the result, the way the handler does once a shadowed
+// request is done
+func compareAndReport(h *Handler, t *target, route string, primary, shadow response) comparison {
+	c := h.compareResponses(t, route, primary, shadow)
+	h.report(t, route, c)
+	return c
+}
@@ -0,0 +1,83 @@
+package shadow
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	debugHeaderTarget   = "X-Shadow-Target"
+	debugHeaderMatch    = "X-Shadow-Match"
+	debugHeaderStatus   = "X-Shadow-Status"
+	debugHeaderLatency  = "X-Shadow-Latency"
+	debugHeaderMismatch = "X-Shadow-Mismatch"
+)
+
+// DebugHeadersConfig reports how each target's response compares with the primary's in headers on the primary's
+// response, so parity can be checked from a client without going through logs.
+type DebugHeadersConfig struct {
+	// Header and Value, when set, only enable debug headers for requests carrying the header with this secret value.
+	// The header is removed before the request is handled.
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+func (h *Handler) provisionDebugHeaders() error {
+	if h.DebugHeaders == nil {
+		return nil
+	}
+	if h.DebugHeaders.Header != "" && h.DebugHeaders.Value == "" {
+		return fmt.Errorf("debug_headers header %s requires a secret value", h.DebugHeaders.Header)
+	}
+	return nil
+}
+
+// debugRequested reports whether debug headers are enabled for the request
+func (h *Handler) debugRequested(r *http.Request) bool {
+	if h.DebugHeaders.Header == "" {
+		return true
+	}
+	return hasSecret(r, h.DebugHeaders.Header, h.DebugHeaders.Value)
+}
+
+// hasSecret reports whether the request carries the header with the secret value, and removes the header so it
+// isn't passed on
+func hasSecret(r *http.Request, header, secret string) bool {
+	value := r.Header.Get(header)
+	if value == "" {
+		return false
+	}
+	r.Header.Del(header)
+	return subtle.ConstantTimeCompare([]byte(value), []byte(secret)) == 1
+}
+
+// debugHeaders reports each check, with one value per target in each header, in the same order. The mismatch summary
+// is only included if some target differs.
+func debugHeaders(checks []targetCheck) http.Header {
+	header := make(http.Header)
+	var mismatch []string
+	for _, c := range checks {
+		match := strconv.FormatBool(c.ok())
+		if c.skipped != "" {
+			match = "skipped"
+		}
+		header.Add(debugHeaderTarget, c.target.name)
+		header.Add(debugHeaderMatch, match)
+		header.Add(debugHeaderStatus, strconv.Itoa(c.status))
+		header.Add(debugHeaderLatency, c.latency.Round(time.Microsecond).String())
+
+		summary := ""
+		if !c.ok() {
+			summary = c.summary()
+		}
+		mismatch = append(mismatch, summary)
+	}
+	if slices.ContainsFunc(mismatch, func(s string) bool { return s != "" }) {
+		header[debugHeaderMismatch] = mismatch
+	}
+	return header
+}
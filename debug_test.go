@@ -0,0 +1,124 @@
+package shadow
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHandler_ServeHTTP_debugHeaders(t *testing.T) {
+	respond := func(status int, body string) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			if r.Header.Get("X-Debug") != "" {
+				t.Errorf("the secret debug header was passed on")
+			}
+			w.WriteHeader(status)
+			_, err := w.Write([]byte(body))
+			return err
+		}
+	}
+
+	tests := []struct {
+		name          string
+		secret        string
+		primaryStatus int
+		unsampled     bool
+		want          http.Header
+		wantTrailer   bool
+	}{
+		{name: "without the secret", primaryStatus: http.StatusOK},
+		{name: "with the wrong secret", secret: "guess", primaryStatus: http.StatusOK},
+		{
+			name:          "with the secret",
+			secret:        "s3cret",
+			primaryStatus: http.StatusOK,
+			want: http.Header{
+				debugHeaderTarget:   {"same", "different"},
+				debugHeaderMatch:    {"true", "false"},
+				debugHeaderStatus:   {"200", "200"},
+				debugHeaderMismatch: {"", "differs in body"},
+			},
+		},
+		{
+			name:          "not sampled",
+			secret:        "s3cret",
+			primaryStatus: http.StatusOK,
+			unsampled:     true,
+			want: http.Header{
+				debugHeaderTarget: {"same", "different"},
+				debugHeaderMatch:  {"true", "false"},
+			},
+		},
+		{
+			name:          "streamed",
+			secret:        "s3cret",
+			primaryStatus: http.StatusNotFound,
+			want: http.Header{
+				debugHeaderTarget: {"same", "different"},
+				debugHeaderMatch:  {"false", "false"},
+			},
+			wantTrailer: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(respond(tt.primaryStatus, "primary"), nil)
+			h.targets = []*target{
+				{name: "same", handler: respond(http.StatusOK, "primary"), sampleRate: 1, timeout: 30 * time.Second,
+					ComparisonConfig: ComparisonConfig{CompareBody: true}},
+				{name: "different", handler: respond(http.StatusOK, "shadow"), sampleRate: 1, timeout: 30 * time.Second,
+					ComparisonConfig: ComparisonConfig{CompareBody: true}},
+			}
+			if tt.unsampled {
+				for _, tg := range h.targets {
+					tg.sampleRate = 0
+				}
+			}
+			h.DebugHeaders = &DebugHeadersConfig{Header: "X-Debug", Value: "s3cret"}
+
+			r := prepareRequest(httptest.NewRequest("GET", "/", nil))
+			if tt.secret != "" {
+				r.Header.Set("X-Debug", tt.secret)
+			}
+			w := httptest.NewRecorder()
+			if err := h.ServeHTTP(w, r, nextHandler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if got := w.Body.String(); got != "primary" {
+				t.Errorf("body = %q, want the primary's response", got)
+			}
+
+			res := w.Result()
+			got, other := res.Header, res.Trailer
+			if tt.wantTrailer {
+				got, other = res.Trailer, res.Header
+			}
+			if other.Get(debugHeaderTarget) != "" {
+				t.Errorf("debug headers were reported in the wrong place")
+			}
+			if tt.want == nil {
+				if got.Get(debugHeaderTarget) != "" {
+					t.Errorf("debug headers = %v, want none", got)
+				}
+				return
+			}
+			for k, want := range tt.want {
+				if !slices.Equal(got[k], want) {
+					t.Errorf("%s = %q, want %q", k, got[k], want)
+				}
+			}
+			if len(got[debugHeaderLatency]) != 2 {
+				t.Errorf("%s = %q, want a latency for each target", debugHeaderLatency, got[debugHeaderLatency])
+			}
+		})
+	}
+}
+
+func TestHandler_provisionDebugHeaders(t *testing.T) {
+	h := &Handler{DebugHeaders: &DebugHeadersConfig{Header: "X-Debug"}}
+	if err := h.provisionDebugHeaders(); err == nil {
+		t.Errorf("provisionDebugHeaders() should require a secret value with a header")
+	}
+}
@@ -0,0 +1,169 @@
+package shadow
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	skipReasonDecodeFailed = "decode_failed"
+
+	// skipReasonHashOnlyEncoded is why a response isn't compared when the primary's body was too large to capture, so
+	// only its hash is left, and either body is encoded. The hash is of the bytes as they were sent, and encoders don't
+	// agree byte for byte, so comparing it would only report bogus mismatches.
+	skipReasonHashOnlyEncoded = "hash_only_encoded"
+)
+
+var (
+	errDecodedTooLarge = errors.New("decoded body is too large")
+	errHashOnlyEncoded = errors.New("primary's body was only hashed, and a body is encoded")
+)
+
+// skipReason returns why a response isn't compared, when it couldn't be decoded for comparison
+func skipReason(err error) string {
+	if errors.Is(err, errHashOnlyEncoded) {
+		return skipReasonHashOnlyEncoded
+	}
+	return skipReasonDecodeFailed
+}
+
+// contentEncodings returns the codings applied to a response body, in the order they were applied, leaving out
+// identity
+func contentEncodings(hdr http.Header) (encodings []string) {
+	for _, v := range hdr.Values("Content-Encoding") {
+		for _, e := range strings.Split(v, ",") {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if e != "" && e != "identity" {
+				encodings = append(encodings, e)
+			}
+		}
+	}
+	return encodings
+}
+
+// decodable reports whether we're able to decode a response body for comparison
+func decodable(hdr http.Header) bool {
+	for _, e := range contentEncodings(hdr) {
+		if !slices.Contains([]string{"gzip", "x-gzip", "deflate", "br", "zstd"}, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// decode returns the response with its body decoded according to its Content-Encoding, so responses encoded
+// differently by each side can be compared. The headers are left as they are.
+func (h *Handler) decode(resp response) (response, error) {
+	encodings := contentEncodings(resp.header)
+	if len(encodings) == 0 || len(resp.body) == 0 {
+		return resp, nil
+	}
+
+	body := resp.body
+	for _, e := range slices.Backward(encodings) {
+		var err error
+		body, err = decodeBody(e, body, h.maxDecodedSize)
+		if err != nil {
+			return resp, fmt.Errorf("error decoding %s body: %w", e, err)
+		}
+	}
+	resp.body = body
+	return resp, nil
+}
+
+// decodeFor decodes a response for comparison with the primary's by a target. Bodies compared by hash are compared as
+// they were sent, so they're left alone. A primary's body which was only hashed because it was too large to capture
+// can't be compared with an encoded body, or at all if it was encoded itself.
+func (h *Handler) decodeFor(t *target, primary, resp response) (response, error) {
+	if t.CompareBodyHash == "" && primary.hashOnly &&
+		(len(contentEncodings(primary.header)) > 0 || len(contentEncodings(resp.header)) > 0) {
+		return resp, errHashOnlyEncoded
+	}
+	if t.bodyHash(primary) != "" {
+		return resp, nil
+	}
+	return h.decode(resp)
+}
+
+// primaryResponse is the primary's response as it was sent, which is decoded once, by whichever comparison needs it
+// first
+type primaryResponse struct {
+	response
+	decoded func() (response, error)
+}
+
+func (h *Handler) newPrimaryResponse(resp response) *primaryResponse {
+	return &primaryResponse{response: resp, decoded: sync.OnceValues(func() (response, error) {
+		return h.decode(resp)
+	})}
+}
+
+// decodeResponses decodes the primary's response and a target's for comparison, once the shadowed request is done
+func (h *Handler) decodeResponses(s *shadowRequest, primary *primaryResponse) (p, shadow response, err error) {
+	p = primary.response
+	if s.target.bodyHash(p) == "" {
+		p, err = primary.decoded()
+		if err != nil {
+			return p, shadow, fmt.Errorf("primary: %w", err)
+		}
+	}
+	shadow, err = h.decodeFor(s.target, p, s.response())
+	if err != nil {
+		return p, shadow, fmt.Errorf("shadow: %w", err)
+	}
+	return p, shadow, nil
+}
+
+// decodeBody decodes a body with a single coding, guarding against decompression bombs by refusing to decode more than
+// max bytes
+func decodeBody(encoding string, body []byte, max int64) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case "deflate":
+		// deflate is meant to be zlib wrapped, but some servers send raw deflate
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(body))
+		} else {
+			r = zr
+		}
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unsupported encoding")
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > max {
+		return nil, errDecodedTooLarge
+	}
+	return decoded, nil
+}
@@ -0,0 +1,136 @@
+package shadow
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encode compresses a body with a single coding, as an upstream would
+func encode(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		w, _ = zstd.NewWriter(&buf)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandler_decode(t *testing.T) {
+	body := []byte(`{"id":1,"name":"shadow"}`)
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		max      int64
+		want     []byte
+		wantErr  error
+	}{
+		{name: "identity", encoding: "identity", body: body, want: body},
+		{name: "gzip", encoding: "gzip", body: encode(t, "gzip", body), want: body},
+		{name: "x-gzip", encoding: "X-Gzip", body: encode(t, "gzip", body), want: body},
+		{name: "deflate", encoding: "deflate", body: encode(t, "deflate", body), want: body},
+		{name: "raw deflate", encoding: "deflate", body: encode(t, "raw deflate", body), want: body},
+		{name: "brotli", encoding: "br", body: encode(t, "br", body), want: body},
+		{name: "zstd", encoding: "zstd", body: encode(t, "zstd", body), want: body},
+		{name: "several codings", encoding: "gzip, br", body: encode(t, "br", encode(t, "gzip", body)), want: body},
+		{name: "too large", encoding: "gzip", body: encode(t, "gzip", body), max: 10, wantErr: errDecodedTooLarge},
+		{name: "exactly the limit", encoding: "gzip", body: encode(t, "gzip", body), max: int64(len(body)), want: body},
+		{name: "corrupt", encoding: "gzip", body: body, wantErr: gzip.ErrHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{maxDecodedSize: 10 << 20}
+			if tt.max > 0 {
+				h.maxDecodedSize = tt.max
+			}
+			resp := response{status: http.StatusOK, header: http.Header{"Content-Encoding": {tt.encoding}}, body: tt.body}
+			got, err := h.decode(resp)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("decode() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+			if !bytes.Equal(got.body, tt.want) {
+				t.Errorf("decode() body = %q, want %q", got.body, tt.want)
+			}
+			if got.header.Get("Content-Encoding") != tt.encoding {
+				t.Errorf("decode() should leave the headers alone")
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_compressed(t *testing.T) {
+	respond := func(encoding, body string) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Encoding", encoding)
+			w.WriteHeader(http.StatusOK)
+			_, err := w.Write(encode(t, encoding, []byte(body)))
+			return err
+		}
+	}
+
+	tests := []struct {
+		name       string
+		shadow     handlerFunc
+		wantStatus int
+	}{
+		{name: "same body, different encodings", shadow: respond("br", `{"id":1}`), wantStatus: http.StatusOK},
+		{name: "different body", shadow: respond("zstd", `{"id":2}`), wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(respond("gzip", `{"id":1}`), tt.shadow)
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareBody: true}
+			h.Verify = &VerifyConfig{Status: http.StatusConflict}
+
+			w := httptest.NewRecorder()
+			if err := h.ServeHTTP(w, prepareRequest(httptest.NewRequest("GET", "/", nil)), nextHandler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if !strings.Contains(w.Body.String(), "differs in body/id") {
+					t.Errorf("body = %q, want a mismatch in body/id", w.Body)
+				}
+				return
+			}
+			if !bytes.Equal(w.Body.Bytes(), encode(t, "gzip", []byte(`{"id":1}`))) || w.Header().Get("Content-Encoding") != "gzip" {
+				t.Errorf("the client should get the primary's original encoded response")
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// DiffResponseConfig lets developers see how a request is handled by the primary and every target side by side. A
+// request carrying Header with the secret Value is answered with a JSON document holding each response and the result
+// of each configured comparison, instead of the primary's response.
+//
+// Diffs are mirrored regardless of sampling, though shadow_match, the unsafe method policy and the shadowing limits
+// still apply. They're left out of comparison logs and metrics.
+type DiffResponseConfig struct {
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+func (h *Handler) provisionDiffResponse() error {
+	if h.DiffResponse == nil {
+		return nil
+	}
+	if h.DiffResponse.Header == "" || h.DiffResponse.Value == "" {
+		return fmt.Errorf("diff_response requires a header and a secret value")
+	}
+	return nil
+}
+
+// diffRequested reports whether the request asks for a diff instead of the primary's response
+func (h *Handler) diffRequested(r *http.Request) bool {
+	return hasSecret(r, h.DiffResponse.Header, h.DiffResponse.Value)
+}
+
+// diffReport is the document sent in place of the primary's response
+type diffReport struct {
+	RequestID string         `json:"request_id"`
+	Primary   diffResponse   `json:"primary"`
+	Targets   []diffedTarget `json:"targets"`
+}
+
+type diffResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+
+	// Body is embedded as is when it's JSON, and as a string otherwise
+	Body    any    `json:"body"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+type diffedTarget struct {
+	Name string `json:"name"`
+	diffResponse
+
+	// Match is false when the target's response differs from the primary's in any field which isn't ignored or
+	// learned as noise. Skipped explains why the responses weren't compared at all.
+	Match       bool            `json:"match"`
+	Skipped     string          `json:"skipped,omitempty"`
+	Regressions []string        `json:"regressions,omitempty"`
+	Ignored     []string        `json:"ignored,omitempty"`
+	Noise       []string        `json:"noise,omitempty"`
+	Comparisons diffComparisons `json:"comparisons"`
+}
+
+// diffComparisons holds the result of each comparison configured for a target
+type diffComparisons struct {
+	Status  *statusComparison  `json:"status,omitempty"`
+	Headers []headerComparison `json:"headers,omitempty"`
+	Body    *bodyComparison    `json:"body,omitempty"`
+	JQ      []jqComparison     `json:"jq,omitempty"`
+}
+
+type statusComparison struct {
+	Match   bool `json:"match"`
+	Primary int  `json:"primary"`
+	Shadow  int  `json:"shadow"`
+}
+
+type headerComparison struct {
+	Name    string   `json:"name"`
+	Match   bool     `json:"match"`
+	Primary []string `json:"primary"`
+	Shadow  []string `json:"shadow"`
+}
+
+type bodyComparison struct {
+	Match bool `json:"match"`
+
+	// Fields are the paths of the fields which differ, for JSON bodies
+	Fields []string `json:"fields,omitempty"`
+}
+
+type jqComparison struct {
+	Query   JQQuery `json:"query"`
+	Match   bool    `json:"match"`
+	Primary []any   `json:"primary"`
+	Shadow  []any   `json:"shadow"`
+}
+
+// writeDiff waits for every target, and responds with a diff of their responses and the primary's. Compressed bodies
+// are shown decoded where possible. The shadows' buffers are returned to the pool.
+func (h *Handler) writeDiff(w http.ResponseWriter, header http.Header, requestID, route string, primary response, latency time.Duration, primaryErr error, shadows []*shadowRequest, body *bodyMux) error {
+	decodedPrimary := h.newPrimaryResponse(primary)
+	decoded, _ := decodedPrimary.decoded()
+	report := diffReport{RequestID: requestID, Primary: newDiffResponse(decoded, latency, primaryErr)}
+	for _, s := range shadows {
+		<-s.done
+		defer bufferPool.Put(s.buf)
+		report.Targets = append(report.Targets, h.diffTarget(s, decodedPrimary, primaryErr, route, body))
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding diff: %w", err)
+	}
+	return writeResponse(w, header, response{
+		status: http.StatusOK,
+		header: http.Header{
+			"Content-Type":  {"application/json"},
+			"Cache-Control": {"no-store"},
+		},
+		body: append(b, '\n'),
+	})
+}
+
+func newDiffResponse(resp response, latency time.Duration, err error) diffResponse {
+	d := diffResponse{
+		Status:  resp.status,
+		Headers: resp.header,
+		Body:    string(resp.body),
+		Latency: latency.Round(time.Microsecond).String(),
+	}
+	if json.Valid(resp.body) {
+		d.Body = json.RawMessage(resp.body)
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	return d
+}
+
+// diffTarget compares a target's response with the primary's, the same way as comparisons in the background, but
+// reports the result of each comparison rather than logging mismatches
+func (h *Handler) diffTarget(s *shadowRequest, decodedPrimary *primaryResponse, primaryErr error, route string, body *bodyMux) diffedTarget {
+	// A body which can't be decoded is shown as it is
+	t := s.target
+	shown, _ := h.decode(s.response())
+	d := diffedTarget{Name: t.name, diffResponse: newDiffResponse(shown, s.latency, s.err)}
+	primary, shadow, decodeErr := h.decodeResponses(s, decodedPrimary)
+	bodySkipped := body.incomplete()
+	switch {
+	case s.cancelled:
+		d.Skipped = "cancelled"
+		return d
+	case bodySkipped != "":
+		d.Skipped = bodySkipped
+		return d
+	case primaryErr != nil || s.err != nil:
+		d.Skipped = "error"
+		return d
+	case decodeErr != nil:
+		d.Skipped = skipReason(decodeErr)
+		return d
+	}
+
+	c := h.compareResponses(t, route, primary, shadow)
+	if t.CompareStatus {
+		d.Comparisons.Status = &statusComparison{
+			Match:   primary.status == shadow.status,
+			Primary: primary.status,
+			Shadow:  shadow.status,
+		}
+	}
+	for _, k := range t.CompareHeaders {
+		ph, sh := primary.header.Values(k), shadow.header.Values(k)
+		d.Comparisons.Headers = append(d.Comparisons.Headers, headerComparison{
+			Name:    http.CanonicalHeaderKey(k),
+			Match:   slices.Equal(ph, sh),
+			Primary: ph,
+			Shadow:  sh,
+		})
+	}
+	switch {
+	case !c.bodyCompared:
+	case len(t.compareJQ) > 0:
+		var pv, sv any
+		_ = json.Unmarshal(primary.body, &pv)
+		_ = json.Unmarshal(shadow.body, &sv)
+		for i, jq := range t.compareJQ {
+			d.Comparisons.JQ = append(d.Comparisons.JQ, jqComparison{
+				Query:   t.CompareJQ[i],
+				Match:   !slices.Contains(c.bodyDiffs, "jq/"+string(t.CompareJQ[i])),
+				Primary: jqResults(jq, pv),
+				Shadow:  jqResults(jq, sv),
+			})
+		}
+	default:
+		d.Comparisons.Body = &bodyComparison{Match: len(c.bodyDiffs) == 0}
+		if json.Valid(primary.body) && json.Valid(shadow.body) {
+			d.Comparisons.Body.Fields = c.bodyDiffs
+		}
+	}
+
+	d.Match, d.Regressions, d.Ignored, d.Noise = c.match(), c.regressions, c.ignored, c.noise
+	return d
+}
+
+// jqResults collects the results of a jq query, with errors reported as strings
+func jqResults(jq *gojq.Query, v any) []any {
+	results := []any{}
+	iter := jq.Run(v)
+	for {
+		result, ok := iter.Next()
+		if !ok {
+			return results
+		}
+		if err, ok := result.(error); ok {
+			result = err.Error()
+		}
+		results = append(results, result)
+	}
+}
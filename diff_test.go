@@ -0,0 +1,142 @@
+package shadow
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHandler_ServeHTTP_diffResponse(t *testing.T) {
+	respond := func(status int, version, body string) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			if r.Header.Get("X-Diff") != "" {
+				t.Errorf("the secret diff header was passed on")
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Version", version)
+			w.WriteHeader(status)
+			_, err := w.Write([]byte(body))
+			return err
+		}
+	}
+	comparisons := ComparisonConfig{CompareStatus: true, CompareHeaders: []string{"x-version"}, CompareBody: true}
+	jq := ComparisonConfig{CompareJQ: []JQQuery{".id", ".at"}}
+	if err := jq.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		secret  string
+		primary handlerFunc
+		want    func(t *testing.T, report diffReport)
+	}{
+		{
+			name:    "without the secret",
+			primary: respond(http.StatusOK, "1", `{"id":1,"at":1}`),
+		},
+		{
+			name:    "with the wrong secret",
+			secret:  "guess",
+			primary: respond(http.StatusOK, "1", `{"id":1,"at":1}`),
+		},
+		{
+			name:    "with the secret",
+			secret:  "t0ken",
+			primary: respond(http.StatusOK, "1", `{"id":1,"at":1}`),
+			want: func(t *testing.T, report diffReport) {
+				if report.Primary.Status != http.StatusOK || !reflect.DeepEqual(report.Primary.Body, map[string]any{"id": 1.0, "at": 1.0}) {
+					t.Errorf("primary = %+v, want the primary's response", report.Primary)
+				}
+				if len(report.Targets) != 3 {
+					t.Fatalf("targets = %+v, want every target, whatever its sample rate", report.Targets)
+				}
+
+				same, different, unsampled := report.Targets[0], report.Targets[1], report.Targets[2]
+				if !same.Match || !same.Comparisons.Status.Match || !same.Comparisons.Body.Match {
+					t.Errorf("same = %+v, want a match", same)
+				}
+				if different.Match || !slices.Equal(different.Regressions, []string{"body/at", "header/X-Version", "status"}) {
+					t.Errorf("different regressions = %v, want body/at, header/X-Version and status", different.Regressions)
+				}
+				if c := different.Comparisons.Headers; len(c) != 1 || c[0].Match || c[0].Shadow[0] != "2" {
+					t.Errorf("different headers = %+v, want X-Version to differ", c)
+				}
+				if c := different.Comparisons.Body; c.Match || !slices.Equal(c.Fields, []string{"body/at"}) {
+					t.Errorf("different body = %+v, want body/at to differ", c)
+				}
+				if different.Status != http.StatusCreated || different.Latency == "" {
+					t.Errorf("different = %+v, want its own status and latency", different.diffResponse)
+				}
+				if c := unsampled.Comparisons.JQ; len(c) != 2 || !c[0].Match || c[1].Match || c[1].Shadow[0] != 2.0 {
+					t.Errorf("jq = %+v, want .id to match and .at to differ", c)
+				}
+			},
+		},
+		{
+			name:    "primary error",
+			secret:  "t0ken",
+			primary: func(http.ResponseWriter, *http.Request) error { return errors.New("primary is down") },
+			want: func(t *testing.T, report diffReport) {
+				if report.Primary.Error != "primary is down" {
+					t.Errorf("primary error = %q, want the primary's error", report.Primary.Error)
+				}
+				for _, target := range report.Targets {
+					if target.Skipped != "error" {
+						t.Errorf("%s skipped = %q, want error", target.Name, target.Skipped)
+					}
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(tt.primary, nil)
+			h.targets = []*target{
+				{name: "same", handler: respond(http.StatusOK, "1", `{"id":1,"at":1}`), sampleRate: 1, timeout: 30 * time.Second,
+					ComparisonConfig: comparisons},
+				{name: "different", handler: respond(http.StatusCreated, "2", `{"id":1,"at":2}`), sampleRate: 1, timeout: 30 * time.Second,
+					ComparisonConfig: comparisons},
+				{name: "unsampled", handler: respond(http.StatusOK, "1", `{"id":1,"at":2}`), timeout: 30 * time.Second,
+					ComparisonConfig: jq},
+			}
+			h.DiffResponse = &DiffResponseConfig{Header: "X-Diff", Value: "t0ken"}
+
+			r := prepareRequest(httptest.NewRequest("GET", "/", nil))
+			if tt.secret != "" {
+				r.Header.Set("X-Diff", tt.secret)
+			}
+			w := httptest.NewRecorder()
+			if err := h.ServeHTTP(w, r, nextHandler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if tt.want == nil {
+				if got := w.Body.String(); got != `{"id":1,"at":1}` {
+					t.Errorf("body = %q, want the primary's response", got)
+				}
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "application/json" || w.Header().Get("X-Version") != "" {
+				t.Errorf("response = %d %v, want a JSON diff without the primary's headers", w.Code, w.Header())
+			}
+			var report diffReport
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatalf("error decoding diff: %v", err)
+			}
+			tt.want(t, report)
+		})
+	}
+}
+
+func TestHandler_provisionDiffResponse(t *testing.T) {
+	h := &Handler{DiffResponse: &DiffResponseConfig{Header: "X-Diff"}}
+	if err := h.provisionDiffResponse(); err == nil {
+		t.Errorf("provisionDiffResponse() should require a secret value")
+	}
+}
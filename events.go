@@ -0,0 +1,322 @@
+package shadow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxEventSize is the largest event recorded for comparison. A stream with a larger event isn't compared.
+const maxEventSize = 1 << 20
+
+// EventsConfig compares text/event-stream responses event by event, rather than as a body, since an event stream may
+// never end. The event type and data of each event are compared, through the jq queries if there are any, and event
+// IDs are ignored.
+type EventsConfig struct {
+	// MaxEvents is how many events from the start of each stream are compared, defaulting to 10.
+	MaxEvents int `json:"max_events,omitempty"`
+	maxEvents int
+
+	// MaxDuration bounds how long to wait for the events, defaulting to 10s. Only the events received by then are
+	// compared.
+	MaxDuration string `json:"max_duration,omitempty"`
+	maxDuration time.Duration
+}
+
+func (c *EventsConfig) provision() (err error) {
+	if c.MaxEvents < 0 {
+		return fmt.Errorf("max_events must not be negative, got %d", c.MaxEvents)
+	}
+	c.maxEvents = 10
+	if c.MaxEvents != 0 {
+		c.maxEvents = c.MaxEvents
+	}
+	c.maxDuration = 10 * time.Second
+	if c.MaxDuration != "" {
+		c.maxDuration, err = time.ParseDuration(c.MaxDuration)
+		if err != nil {
+			return fmt.Errorf("error parsing max_duration: %w", err)
+		}
+	}
+	return nil
+}
+
+// isEventStream reports whether a response is a stream of server-sent events
+func isEventStream(hdr http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// serverSentEvent is an event from an event stream, leaving out its ID
+type serverSentEvent struct {
+	Type string
+	Data string
+}
+
+// eventRecorder parses an event stream as it's written, recording up to max events
+type eventRecorder struct {
+	mu     sync.Mutex
+	max    int
+	stream bool
+	events []serverSentEvent
+
+	// changed is closed and replaced whenever an event is recorded, or the stream ends
+	changed    chan struct{}
+	finished   bool
+	cut        bool
+	overflowed bool
+
+	// The event being parsed
+	line      []byte
+	lastCR    bool
+	eventType string
+	data      []byte
+}
+
+func newEventRecorder(max int) *eventRecorder {
+	return &eventRecorder{max: max, changed: make(chan struct{})}
+}
+
+func (r *eventRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 && r.stream && !r.finished && len(r.events) < r.max {
+		// Lines end with CRLF, LF or CR
+		if r.lastCR && p[0] == '\n' {
+			p = p[1:]
+		}
+		r.lastCR = false
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			r.line = append(r.line, p...)
+			p = nil
+		} else {
+			r.line = append(r.line, p[:i]...)
+			r.lastCR = p[i] == '\r'
+			p = p[i+1:]
+		}
+		if len(r.line)+len(r.data) > maxEventSize {
+			r.overflowed = true
+			r.finish(false)
+			break
+		}
+		if i >= 0 {
+			r.parseLine()
+		}
+	}
+	return n, nil
+}
+
+// parseLine handles a complete line. A blank line dispatches the event.
+func (r *eventRecorder) parseLine() {
+	line := r.line
+	r.line = r.line[:0]
+	switch {
+	case len(line) == 0:
+		if len(r.data) > 0 {
+			eventType := r.eventType
+			if eventType == "" {
+				eventType = "message"
+			}
+			// The data is every data line, each followed by a newline but the last
+			r.events = append(r.events, serverSentEvent{Type: eventType, Data: string(r.data[:len(r.data)-1])})
+			r.notify()
+		}
+		r.eventType, r.data = "", r.data[:0]
+	case line[0] == ':':
+		// A comment, often sent to keep the connection alive
+	default:
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "event":
+			r.eventType = string(value)
+		case "data":
+			r.data = append(append(r.data, value...), '\n')
+		}
+	}
+}
+
+func (r *eventRecorder) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// start marks the response as an event stream, which is only recorded once it's known to be one
+func (r *eventRecorder) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stream = true
+}
+
+// end marks the end of the response. A response which was cut short, because the client went away or the request
+// timed out, doesn't count as the end of the stream.
+func (r *eventRecorder) end(cut bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finish(cut)
+}
+
+func (r *eventRecorder) finish(cut bool) {
+	if !r.finished {
+		r.finished, r.cut = true, cut
+		r.notify()
+	}
+}
+
+// wait returns the first n events, once they've been recorded, the response has ended, or deadline is done. ended
+// reports whether the stream ended on its own before n events were recorded.
+func (r *eventRecorder) wait(n int, deadline <-chan struct{}) (events []serverSentEvent, ended bool) {
+	for {
+		r.mu.Lock()
+		if len(r.events) >= n || r.finished {
+			break
+		}
+		changed := r.changed
+		r.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			r.mu.Lock()
+			events = slices.Clone(r.events[:min(n, len(r.events))])
+			r.mu.Unlock()
+			return events, false
+		}
+	}
+	defer r.mu.Unlock()
+	events = slices.Clone(r.events[:min(n, len(r.events))])
+	return events, len(events) < n && r.finished && !r.cut
+}
+
+// isStream reports whether the response is an event stream, and whether it had an event too large to record
+func (r *eventRecorder) isStream() (stream, overflowed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stream, r.overflowed
+}
+
+// eventWriter passes a response through, parsing it into events as it's written if it's a 2xx event stream
+type eventWriter struct {
+	http.ResponseWriter
+	events      *eventRecorder
+	wroteHeader bool
+}
+
+func newEventWriter(w http.ResponseWriter, maxEvents int) *eventWriter {
+	return &eventWriter{ResponseWriter: w, events: newEventRecorder(maxEvents)}
+}
+
+func (w *eventWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		// Informational responses are followed by the real one
+		w.wroteHeader = true
+		if status < 300 && isEventStream(w.Header()) {
+			w.events.start()
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	_, _ = w.events.Write(p[:n])
+	return n, err
+}
+
+func (w *eventWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// compareEventStreams compares the first events of the primary's event stream with a target's, as soon as both have
+// sent enough of them, either has ended, or the target's time limit is up. The target's stream is then stopped, since
+// the rest of it isn't needed. Responses which aren't event streams are left to the other comparisons.
+func (h *Handler) compareEventStreams(s *shadowRequest, primary *eventRecorder) {
+	t, cfg := s.target, s.target.CompareEvents
+	go func() {
+		<-s.done
+		s.events.end(s.cancelled)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.maxDuration)
+	defer cancel()
+	primaryEvents, primaryEnded := primary.wait(cfg.maxEvents, ctx.Done())
+	if stream, _ := primary.isStream(); !stream {
+		return
+	}
+	shadowEvents, shadowEnded := s.events.wait(cfg.maxEvents, ctx.Done())
+
+	_, primaryOverflowed := primary.isStream()
+	shadowStream, shadowOverflowed := s.events.isStream()
+	if shadowStream {
+		// The rest of the shadow's stream won't be compared, and its status and headers are already known
+		defer s.stop(errNotNeeded)
+	}
+	if primaryOverflowed || shadowOverflowed {
+		h.slogger.Debug("shadow_comparison_skipped", slog.String("target", t.name), slog.String("reason", dropReasonBodyTooLarge))
+		return
+	}
+	h.compareEvents(t, primaryEvents, shadowEvents, primaryEnded, shadowEnded)
+}
+
+// compareEvents compares two sequences of events, reporting the first which differs. A side with fewer events only
+// counts as a difference if its stream ended, rather than running out of time.
+func (h *Handler) compareEvents(t *target, primary, shadow []serverSentEvent, primaryEnded, shadowEnded bool) {
+	n := min(len(primary), len(shadow))
+	first := n
+	for i := range n {
+		if !t.eventEqual(primary[i], shadow[i]) {
+			first = i
+			break
+		}
+	}
+	match := first == n &&
+		(len(primary) == len(shadow) ||
+			len(primary) < len(shadow) && !primaryEnded ||
+			len(shadow) < len(primary) && !shadowEnded)
+
+	if h.MetricsName != "" {
+		if match {
+			t.metrics.match.Inc()
+		} else {
+			t.metrics.mismatch.Inc()
+		}
+	}
+	if match || h.NoLog {
+		return
+	}
+
+	attrs := []any{
+		"target", t.name,
+		"event", first,
+		"primary_events", len(primary),
+		"shadow_events", len(shadow),
+	}
+	if first < len(primary) {
+		attrs = append(attrs, "primary_event", primary[first].Type, "primary_data", primary[first].Data)
+	}
+	if first < len(shadow) {
+		attrs = append(attrs, "shadow_event", shadow[first].Type, "shadow_data", shadow[first].Data)
+	}
+	h.slogger.Info("shadow_event_mismatch", attrs...)
+}
+
+// eventEqual compares the type and data of two events. With jq queries, the data is compared as JSON through them.
+func (c *ComparisonConfig) eventEqual(primary, shadow serverSentEvent) bool {
+	if primary.Type != shadow.Type {
+		return false
+	}
+	if len(c.compareJQ) > 0 {
+		return c.compareJSON([]byte(primary.Data), []byte(shadow.Data))
+	}
+	return primary.Data == shadow.Data
+}
@@ -0,0 +1,237 @@
+package shadow
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEventRecorder(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []serverSentEvent
+	}{
+		{name: "single event", stream: "data: hello\n\n", want: []serverSentEvent{{Type: "message", Data: "hello"}}},
+		{name: "multi-line data", stream: "data: a\ndata: b\n\n", want: []serverSentEvent{{Type: "message", Data: "a\nb"}}},
+		{
+			name:   "typed events with ids and comments",
+			stream: ": keep-alive\nid: 1\nevent: update\ndata: {\"n\":1}\n\nid: 2\ndata:no space\n\n",
+			want:   []serverSentEvent{{Type: "update", Data: `{"n":1}`}, {Type: "message", Data: "no space"}},
+		},
+		{name: "CRLF and CR", stream: "data: a\r\n\r\ndata: b\r\rdata: c\n\n", want: []serverSentEvent{{Type: "message", Data: "a"}, {Type: "message", Data: "b"}, {Type: "message", Data: "c"}}},
+		{name: "no data", stream: "event: ping\n\ndata\n\n", want: []serverSentEvent{{Type: "message", Data: ""}}},
+		{name: "unfinished event", stream: "data: a\n\ndata: b\n", want: []serverSentEvent{{Type: "message", Data: "a"}}},
+		{name: "limited", stream: "data: 1\n\ndata: 2\n\ndata: 3\n\ndata: 4\n\n", want: []serverSentEvent{{Type: "message", Data: "1"}, {Type: "message", Data: "2"}, {Type: "message", Data: "3"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The stream is written a byte at a time, so every line is split across writes
+			r := newEventRecorder(3)
+			r.start()
+			for _, b := range []byte(tt.stream) {
+				_, _ = r.Write([]byte{b})
+			}
+			r.end(false)
+
+			got, _ := r.wait(3, nil)
+			if len(got) != len(tt.want) {
+				t.Fatalf("events = %q, want %q", got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("event %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// eventStream responds with an event stream, flushing each event, then holds the stream open until hold is closed or
+// the request is cancelled
+func eventStream(events []string, hold <-chan struct{}) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range events {
+			if _, err := w.Write([]byte(e)); err != nil {
+				return err
+			}
+			_ = http.NewResponseController(w).Flush()
+		}
+		if hold != nil {
+			select {
+			case <-hold:
+			case <-r.Context().Done():
+				return r.Context().Err()
+			}
+		}
+		return nil
+	}
+}
+
+func TestHandler_ServeHTTP_compareEvents(t *testing.T) {
+	primary := []string{
+		"id: 1\ndata: {\"n\":1,\"at\":\"10:00\"}\n\n",
+		"id: 2\nevent: tick\ndata: {\"n\":2,\"at\":\"10:01\"}\n\n",
+		"id: 3\ndata: {\"n\":3,\"at\":\"10:02\"}\n\n",
+	}
+	tests := []struct {
+		name      string
+		shadow    []string
+		cfg       EventsConfig
+		jq        string
+		hold      bool
+		wantMatch bool
+		wantLog   string
+	}{
+		{name: "same events", shadow: primary, wantMatch: true},
+		{
+			name: "different ids",
+			shadow: []string{
+				"id: a\ndata: {\"n\":1,\"at\":\"10:00\"}\n\n",
+				"id: b\nevent: tick\ndata: {\"n\":2,\"at\":\"10:01\"}\n\n",
+				"id: c\ndata: {\"n\":3,\"at\":\"10:02\"}\n\n",
+			},
+			wantMatch: true,
+		},
+		{
+			name:    "different type",
+			shadow:  []string{primary[0], "data: {\"n\":2,\"at\":\"10:01\"}\n\n", primary[2]},
+			wantLog: "event=1",
+		},
+		{
+			name: "different timestamps through jq",
+			shadow: []string{
+				"data: {\"n\":1,\"at\":\"11:00\"}\n\n",
+				"event: tick\ndata: {\"n\":2,\"at\":\"11:01\"}\n\n",
+				"data: {\"n\":3,\"at\":\"11:02\"}\n\n",
+			},
+			jq:        ".n",
+			wantMatch: true,
+		},
+		{name: "fewer events", shadow: primary[:2], wantLog: "event=2"},
+		{name: "only the first events", shadow: []string{primary[0], primary[1], "data: {}\n\n"}, cfg: EventsConfig{MaxEvents: 2}, wantMatch: true},
+		{name: "time limit", shadow: primary[:1], cfg: EventsConfig{MaxDuration: "20ms"}, hold: true, wantMatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hold := make(chan struct{})
+			release := sync.OnceFunc(func() { close(hold) })
+			defer release()
+			var primaryHold, shadowHold <-chan struct{}
+			primaryEvents := primary
+			if tt.hold {
+				// Neither stream ends, so only the events sent before the time limit are compared
+				primaryEvents, primaryHold, shadowHold = primary[:1], hold, hold
+			}
+
+			h := newTestHandler(eventStream(primaryEvents, primaryHold), eventStream(tt.shadow, shadowHold))
+			cfg := tt.cfg
+			if err := cfg.provision(); err != nil {
+				t.Fatalf("provision() error = %v", err)
+			}
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareEvents: &cfg}
+			if tt.jq != "" {
+				q, _ := gojq.Parse(tt.jq)
+				h.targets[0].compareJQ = []*gojq.Query{q}
+			}
+			logs := make(logWriter, 10)
+			h.slogger = slog.New(slog.NewTextHandler(logs, nil))
+			withMetrics(t, h)
+
+			downstream := httptest.NewRecorder()
+			served := make(chan error, 1)
+			go func() {
+				served <- h.ServeHTTP(downstream, prepareRequest(httptest.NewRequest("GET", "/events", nil)), nextHandler)
+			}()
+
+			m := h.targets[0].metrics
+			for deadline := time.Now().Add(time.Second); testutil.ToFloat64(m.match)+testutil.ToFloat64(m.mismatch) == 0; {
+				if time.Now().After(deadline) {
+					t.Fatal("the event streams were never compared")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if match := testutil.ToFloat64(m.match) > 0; match != tt.wantMatch {
+				t.Errorf("match = %v, want %v", match, tt.wantMatch)
+			}
+			if tt.wantLog != "" {
+				if line := <-logs; !strings.Contains(line, "shadow_event_mismatch") || !strings.Contains(line, tt.wantLog) {
+					t.Errorf("log = %q, want a mismatch with %s", line, tt.wantLog)
+				}
+			}
+
+			if tt.hold {
+				select {
+				case <-served:
+					t.Fatal("the streams should be compared while they're still open")
+				default:
+				}
+				release()
+			}
+			if err := <-served; err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if got := downstream.Body.String(); got != strings.Join(primaryEvents, "") {
+				t.Errorf("body = %q, want the primary's events", got)
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_compareEventsStopsShadow(t *testing.T) {
+	events := []string{"data: 1\n\n", "data: 2\n\n"}
+	stopped := make(chan error, 1)
+	shadow := func(w http.ResponseWriter, r *http.Request) error {
+		err := eventStream(events, make(chan struct{}))(w, r)
+		stopped <- context.Cause(r.Context())
+		return err
+	}
+
+	h := newTestHandler(eventStream(events, nil), shadow)
+	cfg := EventsConfig{MaxEvents: len(events)}
+	if err := cfg.provision(); err != nil {
+		t.Fatalf("provision() error = %v", err)
+	}
+	h.targets[0].ComparisonConfig = ComparisonConfig{CompareEvents: &cfg}
+	h.targets[0].maxInFlight = 1
+	withMetrics(t, h)
+
+	if err := h.ServeHTTP(httptest.NewRecorder(), prepareRequest(httptest.NewRequest("GET", "/events", nil)), nextHandler); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	// The shadow's stream never ends on its own, so it's stopped as soon as its events are compared, well before the
+	// shadow timeout
+	select {
+	case cause := <-stopped:
+		if !errors.Is(cause, errNotNeeded) {
+			t.Errorf("shadow context cause = %v, want %v", cause, errNotNeeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the shadow's stream was never stopped")
+	}
+
+	m := h.targets[0].metrics
+	for deadline := time.Now().Add(time.Second); h.targets[0].inFlight.Load() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the shadowed request never gave up its max_in_flight slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := testutil.ToFloat64(m.match); got != 1 {
+		t.Errorf("match = %v, want 1", got)
+	}
+	if timeouts, cancellations := testutil.ToFloat64(m.timeouts), testutil.ToFloat64(m.cancellations); timeouts+cancellations != 0 {
+		t.Errorf("timeouts = %v, cancellations = %v, want a stopped stream counted as neither", timeouts, cancellations)
+	}
+}
@@ -0,0 +1,110 @@
+package shadow
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	bodyHashSHA256 = "sha256"
+	bodyHashXXHash = "xxhash"
+)
+
+func newHash(algorithm string) hash.Hash {
+	if algorithm == bodyHashXXHash {
+		return xxhash.New()
+	}
+	return sha256.New()
+}
+
+// bodyDigests hashes a response body as it's written, with each of the algorithms the targets compare by
+type bodyDigests struct {
+	hashes map[string]hash.Hash
+	size   int64
+
+	// streamed records whether the body was hashed as it was written. A response which wasn't, because it was
+	// buffered instead, is hashed from its buffer.
+	streamed bool
+}
+
+func newBodyDigests(algorithms []string) *bodyDigests {
+	d := &bodyDigests{hashes: make(map[string]hash.Hash, len(algorithms))}
+	for _, a := range algorithms {
+		d.hashes[a] = newHash(a)
+	}
+	return d
+}
+
+func (d *bodyDigests) Write(p []byte) (int, error) {
+	for _, h := range d.hashes {
+		_, _ = h.Write(p)
+	}
+	d.size += int64(len(p))
+	return len(p), nil
+}
+
+// bodyDigest is the hash of a response body, along with its length
+type bodyDigest struct {
+	sum  []byte
+	size int64
+}
+
+func (d bodyDigest) equal(other bodyDigest) bool {
+	return d.size == other.size && bytes.Equal(d.sum, other.sum)
+}
+
+func (d bodyDigest) String() string {
+	return hex.EncodeToString(d.sum)
+}
+
+// bodyDigest returns the digest of the response body with algorithm. Only 2xx bodies are hashed as they're written, the
+// same as only 2xx bodies are buffered, so any other body counts as empty.
+func (r response) bodyDigest(algorithm string) bodyDigest {
+	if r.digests != nil && r.digests.streamed {
+		return bodyDigest{sum: r.digests.hashes[algorithm].Sum(nil), size: r.digests.size}
+	}
+	h := newHash(algorithm)
+	_, _ = h.Write(r.body)
+	return bodyDigest{sum: h.Sum(nil), size: int64(len(r.body))}
+}
+
+// hashingWriter passes a response through to the wrapped writer, hashing the body on the way if it's a 2xx response.
+// Wrapped by a response recorder, it only sees the responses which aren't buffered.
+type hashingWriter struct {
+	http.ResponseWriter
+	digests     *bodyDigests
+	wroteHeader bool
+}
+
+func newHashingWriter(w http.ResponseWriter, algorithms []string) *hashingWriter {
+	return &hashingWriter{ResponseWriter: w, digests: newBodyDigests(algorithms)}
+}
+
+func (w *hashingWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		// Informational responses are followed by the real one
+		w.wroteHeader = true
+		w.digests.streamed = status < 300
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *hashingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if w.digests.streamed {
+		_, _ = w.digests.Write(p[:n])
+	}
+	return n, err
+}
+
+func (w *hashingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,127 @@
+package shadow
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHashingWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantSize int64
+		streamed bool
+	}{
+		{name: "ok", statuses: []int{http.StatusOK}, wantSize: 11, streamed: true},
+		{name: "implicit ok", wantSize: 11, streamed: true},
+		{name: "error status", statuses: []int{http.StatusNotFound}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downstream := httptest.NewRecorder()
+			w := newHashingWriter(downstream, []string{bodyHashSHA256, bodyHashXXHash})
+			for _, status := range tt.statuses {
+				w.WriteHeader(status)
+			}
+			_, _ = w.Write([]byte("hello "))
+			_, _ = w.Write([]byte("world"))
+
+			if downstream.Body.String() != "hello world" {
+				t.Errorf("downstream body = %q, want it passed through", downstream.Body)
+			}
+			if w.digests.streamed != tt.streamed || w.digests.size != tt.wantSize {
+				t.Fatalf("streamed = %v, size = %d, want %v, %d", w.digests.streamed, w.digests.size, tt.streamed, tt.wantSize)
+			}
+			if !tt.streamed {
+				return
+			}
+			for _, algorithm := range []string{bodyHashSHA256, bodyHashXXHash} {
+				streamed := response{digests: w.digests}.bodyDigest(algorithm)
+				buffered := response{body: []byte("hello world")}.bodyDigest(algorithm)
+				if !streamed.equal(buffered) {
+					t.Errorf("%s digest = %s, want the same as the buffered body's, %s", algorithm, streamed, buffered)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_compareBodyHash(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		shadow    string
+		verify    bool
+		want      string
+	}{
+		{name: "same body", algorithm: bodyHashSHA256, shadow: "hello world", want: "true"},
+		{name: "different body", algorithm: bodyHashXXHash, shadow: "hello there", want: "false"},
+		{name: "different length", algorithm: bodyHashSHA256, shadow: "hello world!", want: "false"},
+		{name: "buffered primary", algorithm: bodyHashSHA256, shadow: "hello world", verify: true, want: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downstream := httptest.NewRecorder()
+			h := newTestHandler(
+				func(w http.ResponseWriter, r *http.Request) error {
+					_, _ = w.Write([]byte("hello "))
+					if streamed := downstream.Body.Len() > 0; streamed == tt.verify {
+						t.Errorf("streamed = %v before the primary was done, want %v", streamed, !tt.verify)
+					}
+					_, err := w.Write([]byte("world"))
+					return err
+				},
+				func(w http.ResponseWriter, r *http.Request) error {
+					_, err := w.Write([]byte(tt.shadow))
+					return err
+				},
+			)
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareBodyHash: tt.algorithm}
+			h.DebugHeaders = &DebugHeadersConfig{}
+			if tt.verify {
+				h.Verify = &VerifyConfig{Status: http.StatusConflict}
+			}
+
+			if err := h.ServeHTTP(downstream, prepareRequest(httptest.NewRequest("GET", "/", nil)), nextHandler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if got := downstream.Body.String(); got != "hello world" {
+				t.Errorf("body = %q, want the primary's response", got)
+			}
+
+			res := downstream.Result()
+			got := res.Trailer.Get(debugHeaderMatch)
+			if tt.verify {
+				got = res.Header.Get(debugHeaderMatch)
+			}
+			if got != tt.want {
+				t.Errorf("%s = %q, want %q", debugHeaderMatch, got, tt.want)
+			}
+			if mismatch := res.Trailer.Get(debugHeaderMismatch); tt.want == "false" && !strings.Contains(mismatch, "body") {
+				t.Errorf("%s = %q, want a difference in the body", debugHeaderMismatch, mismatch)
+			}
+		})
+	}
+}
+
+func TestComparisonConfig_provision_compareBodyHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       ComparisonConfig
+		wantErr bool
+	}{
+		{name: "sha256", c: ComparisonConfig{CompareBodyHash: bodyHashSHA256}},
+		{name: "xxhash", c: ComparisonConfig{CompareBodyHash: bodyHashXXHash}},
+		{name: "unknown", c: ComparisonConfig{CompareBodyHash: "md5"}, wantErr: true},
+		{name: "with jq", c: ComparisonConfig{CompareBodyHash: bodyHashSHA256, CompareJQ: []JQQuery{".id"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.provision(); (err != nil) != tt.wantErr {
+				t.Errorf("provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
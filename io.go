@@ -1,7 +1,10 @@
 package shadow
 
 import (
+	"bufio"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 )
 
@@ -73,8 +76,34 @@ func (f *TimedWriter) WriteHeader(status int) {
 	f.ResponseWriter.WriteHeader(status)
 }
 
+// FlushError flushes the wrapped writer. Flushing sends the headers if they haven't been sent yet, so it counts as the
+// first byte too.
+func (f *TimedWriter) FlushError() error {
+	f.started()
+	return http.NewResponseController(f.ResponseWriter).Flush()
+}
+
+func (f *TimedWriter) Flush() {
+	_ = f.FlushError()
+}
+
+func (f *TimedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(f.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.NewResponseController reach the features of the wrapped writer, like deadlines
+func (f *TimedWriter) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
 func noop() {}
 
+// errHijackNotAllowed is returned when a handler whose response is never sent, like a shadow's, tries to take over the
+// client's connection
+var errHijackNotAllowed = fmt.Errorf("%w: a discarded response can't hijack the connection", http.ErrNotSupported)
+
+// NopResponseWriter discards a response, keeping only its status and headers. Since nothing is sent, flushing is a
+// no-op, and hijacking is refused.
 type NopResponseWriter struct {
 	header http.Header
 	status int
@@ -94,3 +123,9 @@ func (w *NopResponseWriter) WriteHeader(status int) {
 func (w *NopResponseWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
+
+func (w *NopResponseWriter) Flush() {}
+
+func (w *NopResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errHijackNotAllowed
+}
@@ -0,0 +1,174 @@
+package shadow
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// withMetrics turns metrics on, so the primary and shadow writers are wrapped by TimedWriter
+func withMetrics(t *testing.T, h *Handler) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	h.MetricsName = "test"
+	h.metrics.provision(ctx, h.MetricsName)
+	for _, tg := range h.targets {
+		tg.metrics = h.metrics.forTarget(tg.name)
+	}
+}
+
+// hijackRecorder is a response recorder whose connection can be hijacked
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+func TestHandler_ServeHTTP_serverSentEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics bool
+		c       ComparisonConfig
+		stream  bool
+	}{
+		{name: "mirrored"},
+		{name: "with metrics", metrics: true},
+		{name: "streamed primary", metrics: true, c: ComparisonConfig{CompareBody: true}, stream: true},
+		{name: "hashed bodies", metrics: true, c: ComparisonConfig{CompareBodyHash: bodyHashSHA256}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downstream := httptest.NewRecorder()
+			shadowFlushed := make(chan error, 1)
+			h := newTestHandler(
+				func(w http.ResponseWriter, r *http.Request) error {
+					w.Header().Set("Content-Type", "text/event-stream")
+					_, _ = w.Write([]byte("data: 1\n\n"))
+					if err := http.NewResponseController(w).Flush(); err != nil {
+						t.Errorf("primary Flush() error = %v", err)
+					}
+					if !downstream.Flushed || downstream.Body.String() != "data: 1\n\n" {
+						t.Errorf("the first event should be flushed to the client before the next is written")
+					}
+					_, err := w.Write([]byte("data: 2\n\n"))
+					return err
+				},
+				func(w http.ResponseWriter, r *http.Request) error {
+					w.Header().Set("Content-Type", "text/event-stream")
+					_, _ = w.Write([]byte("data: 1\n\n"))
+					shadowFlushed <- http.NewResponseController(w).Flush()
+					_, err := w.Write([]byte("data: 2\n\n"))
+					return err
+				},
+			)
+			h.targets[0].ComparisonConfig = tt.c
+			h.StreamPrimary, h.captureLimit = tt.stream, 1<<20
+			if tt.metrics {
+				withMetrics(t, h)
+			}
+
+			if err := h.ServeHTTP(downstream, prepareRequest(httptest.NewRequest("GET", "/events", nil)), nextHandler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if got := downstream.Body.String(); got != "data: 1\n\ndata: 2\n\n" {
+				t.Errorf("body = %q, want both events", got)
+			}
+			select {
+			case err := <-shadowFlushed:
+				if err != nil {
+					t.Errorf("shadow Flush() error = %v, want a no-op", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the shadow never flushed")
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_upgrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics bool
+		c       ComparisonConfig
+		verify  bool
+	}{
+		{name: "mirrored"},
+		{name: "with metrics", metrics: true},
+		{name: "compared", metrics: true, c: ComparisonConfig{CompareStatus: true, CompareBody: true}},
+		{name: "verified", c: ComparisonConfig{CompareStatus: true}, verify: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			received := make(chan string, 1)
+			go func() {
+				b, _ := io.ReadAll(client)
+				received <- string(b)
+			}()
+
+			shadowHijacked := make(chan error, 1)
+			h := newTestHandler(
+				func(w http.ResponseWriter, r *http.Request) error {
+					w.Header().Set("Upgrade", "example/1")
+					w.WriteHeader(http.StatusSwitchingProtocols)
+					conn, brw, err := http.NewResponseController(w).Hijack()
+					if err != nil {
+						return err
+					}
+					defer conn.Close()
+					_, _ = brw.WriteString("hello")
+					return brw.Flush()
+				},
+				func(w http.ResponseWriter, r *http.Request) error {
+					w.Header().Set("Upgrade", "example/1")
+					w.WriteHeader(http.StatusSwitchingProtocols)
+					_, _, err := http.NewResponseController(w).Hijack()
+					shadowHijacked <- err
+					return nil
+				},
+			)
+			h.targets[0].ComparisonConfig = tt.c
+			if tt.verify {
+				h.Verify = &VerifyConfig{Status: http.StatusConflict}
+			}
+			if tt.metrics {
+				withMetrics(t, h)
+			}
+
+			downstream := &hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}
+			r := httptest.NewRequest("GET", "/socket", nil)
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "example/1")
+			if err := h.ServeHTTP(downstream, prepareRequest(r), nextHandler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			select {
+			case got := <-received:
+				if got != "hello" {
+					t.Errorf("hijacked connection got %q, want the primary's %q", got, "hello")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the primary never closed the hijacked connection")
+			}
+			select {
+			case err := <-shadowHijacked:
+				if !errors.Is(err, http.ErrNotSupported) {
+					t.Errorf("shadow Hijack() error = %v, want it refused", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the shadow never tried to hijack the connection")
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package shadow
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const defaultRouteKey = "{http.request.method} {http.request.uri.path}"
+
+// learners holds the learned ignore rules, by name. They're shared by every handler with the same name, and survive
+// config reloads for as long as some handler uses them.
+var learners = caddy.NewUsagePool()
+
+// LearnConfig enables learning which fields of the response body regularly differ between the primary and the
+// shadows, for each route. Once a route has been compared MinObservations times, fields which differed in at least
+// Threshold of those comparisons become ignore rules. Rules are only proposed (logged, and listed by the admin API)
+// unless Apply is set, in which case the fields are also left out of comparisons.
+type LearnConfig struct {
+	// Name identifies the learned rules in the admin API, defaulting to "default". Handlers with the same name share
+	// what they learn.
+	Name            string  `json:"name,omitempty"`
+	MinObservations int     `json:"min_observations,omitempty"`
+	Threshold       float64 `json:"threshold,omitempty"`
+	Apply           bool    `json:"apply,omitempty"`
+
+	// MaxRoutes bounds the number of routes learned about, defaulting to 1000
+	MaxRoutes int `json:"max_routes,omitempty"`
+}
+
+const (
+	// maxLearnedFields bounds the number of fields learned about for each route
+	maxLearnedFields = 256
+)
+
+type learner struct {
+	mu sync.RWMutex
+
+	routes map[string]*routeStats
+
+	minObservations int
+	threshold       float64
+	apply           bool
+	maxRoutes       int
+
+	// dropped counts the comparisons not learned from, because they were for a new route once max_routes was reached
+	dropped int
+}
+
+// routeStats counts, for a single route, how many comparisons were made and how many times each field differed
+type routeStats struct {
+	Observations int            `json:"observations"`
+	Differences  map[string]int `json:"differences"`
+	proposed     map[string]bool
+}
+
+func newLearner() *learner {
+	return &learner{routes: make(map[string]*routeStats)}
+}
+
+// configure applies the settings of the most recently provisioned handler
+func (l *learner) configure(cfg *LearnConfig) error {
+	minObservations, threshold, maxRoutes := 100, 0.5, 1000
+	if cfg.MinObservations != 0 {
+		if cfg.MinObservations < 0 {
+			return fmt.Errorf("min_observations must be positive, got %d", cfg.MinObservations)
+		}
+		minObservations = cfg.MinObservations
+	}
+	if cfg.Threshold != 0 {
+		if cfg.Threshold < 0 || cfg.Threshold > 1 {
+			return fmt.Errorf("threshold must be between 0 and 1, got %v", cfg.Threshold)
+		}
+		threshold = cfg.Threshold
+	}
+	if cfg.MaxRoutes != 0 {
+		if cfg.MaxRoutes < 0 {
+			return fmt.Errorf("max_routes must be positive, got %d", cfg.MaxRoutes)
+		}
+		maxRoutes = cfg.MaxRoutes
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.minObservations, l.threshold, l.apply, l.maxRoutes = minObservations, threshold, cfg.Apply, maxRoutes
+	return nil
+}
+
+// Destruct implements caddy.Destructor
+func (l *learner) Destruct() error {
+	return nil
+}
+
+// observe records the fields which differed in a comparison for the route. It returns the fields which have just
+// become ignore rules. If the route is new and max_routes has been reached, nothing is learned, and dropped is the
+// number of comparisons dropped so far, including this one.
+func (l *learner) observe(route string, diffs []string) (proposed []string, dropped int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats, ok := l.routes[route]
+	if !ok {
+		if len(l.routes) >= l.maxRoutes {
+			l.dropped++
+			return nil, l.dropped
+		}
+		stats = &routeStats{Differences: make(map[string]int), proposed: make(map[string]bool)}
+		l.routes[route] = stats
+	}
+
+	stats.Observations++
+	for _, field := range diffs {
+		if _, ok := stats.Differences[field]; ok || len(stats.Differences) < maxLearnedFields {
+			stats.Differences[field]++
+		}
+	}
+
+	for field := range stats.Differences {
+		if !stats.proposed[field] && l.isRule(stats, field) {
+			stats.proposed[field] = true
+			proposed = append(proposed, field)
+		}
+	}
+	slices.Sort(proposed)
+	return proposed, 0
+}
+
+// isRule must be called while holding l.mu
+func (l *learner) isRule(stats *routeStats, field string) bool {
+	return stats.Observations >= l.minObservations &&
+		float64(stats.Differences[field]) >= l.threshold*float64(stats.Observations)
+}
+
+// ignores reports whether a learned rule for the route should be applied to the field
+func (l *learner) ignores(route, field string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.apply {
+		return false
+	}
+	stats, ok := l.routes[route]
+	if !ok {
+		return false
+	}
+	for rule := range stats.Differences {
+		if l.isRule(stats, rule) && fieldMatches(rule, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// rules returns the learned ignore rules in the same form as Handler.IgnoreFields, so they can be copied into config
+func (l *learner) rules() map[string][]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	rules := make(map[string][]string)
+	for route, stats := range l.routes {
+		for field := range stats.Differences {
+			if l.isRule(stats, field) {
+				rules[route] = append(rules[route], field)
+			}
+		}
+		slices.Sort(rules[route])
+	}
+	return rules
+}
+
+// learnedRoute is how a route's learned state is shown by the admin API
+type learnedRoute struct {
+	routeStats
+	Ignore []string `json:"ignore"`
+}
+
+// snapshot returns everything learned so far, by route
+func (l *learner) snapshot() map[string]learnedRoute {
+	rules := l.rules()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	routes := make(map[string]learnedRoute, len(l.routes))
+	for route, stats := range l.routes {
+		routes[route] = learnedRoute{
+			routeStats: routeStats{Observations: stats.Observations, Differences: maps.Clone(stats.Differences)},
+			Ignore:     rules[route],
+		}
+	}
+	return routes
+}
+
+// fieldMatches reports whether an ignore rule covers a field, either exactly or as one of its parents
+func fieldMatches(rule, field string) bool {
+	return field == rule || strings.HasPrefix(field, rule+"/")
+}
+
+// routeKey returns the key the request's route is learned and ignored under
+func (h *Handler) routeKey(r *http.Request) string {
+	key := h.RouteKey
+	if key == "" {
+		key = defaultRouteKey
+	}
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if repl == nil {
+		return ""
+	}
+	return repl.ReplaceAll(key, "")
+}
+
+// ignoring reports whether any fields can be ignored, so that the route key is needed for comparisons
+func (h *Handler) ignoring() bool {
+	return h.learner != nil || len(h.IgnoreFields) > 0
+}
+
+// splitIgnored separates the fields which are covered by an ignore rule for the route, whether configured or learned
+func (h *Handler) splitIgnored(route string, fields []string) (kept, ignored []string) {
+	for _, field := range fields {
+		if h.ignores(route, field) {
+			ignored = append(ignored, field)
+		} else {
+			kept = append(kept, field)
+		}
+	}
+	return kept, ignored
+}
+
+func (h *Handler) ignores(route, field string) bool {
+	for _, rules := range [][]string{h.IgnoreFields[route], h.IgnoreFields["*"]} {
+		for _, rule := range rules {
+			if fieldMatches(rule, field) {
+				return true
+			}
+		}
+	}
+	return h.learner != nil && h.learner.ignores(route, field)
+}
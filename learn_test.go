@@ -0,0 +1,195 @@
+package shadow
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLearner(t *testing.T) {
+	l := newLearner()
+	if err := l.configure(&LearnConfig{MinObservations: 4, Threshold: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+
+	// body/at differs every time, body/name only once, and nothing is proposed before min_observations
+	for i, diffs := range [][]string{{"body/at"}, {"body/at", "body/name"}, {"body/at"}} {
+		if proposed, _ := l.observe("GET /users", diffs); proposed != nil {
+			t.Errorf("observe() #%d = %v, want nothing before min_observations", i, proposed)
+		}
+	}
+	if proposed, _ := l.observe("GET /users", []string{"body/at"}); !slices.Equal(proposed, []string{"body/at"}) {
+		t.Errorf("observe() = %v, want body/at proposed", proposed)
+	}
+	if proposed, _ := l.observe("GET /users", []string{"body/at"}); proposed != nil {
+		t.Errorf("observe() = %v, want body/at only proposed once", proposed)
+	}
+
+	if l.ignores("GET /users", "body/at") {
+		t.Errorf("proposed rules should not be applied without apply")
+	}
+	if err := l.configure(&LearnConfig{MinObservations: 4, Threshold: 0.5, Apply: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !l.ignores("GET /users", "body/at") || l.ignores("GET /users", "body/name") || l.ignores("GET /orders", "body/at") {
+		t.Errorf("applied rules should only ignore body/at for GET /users")
+	}
+
+	want := map[string][]string{"GET /users": {"body/at"}}
+	if rules := l.rules(); len(rules) != 1 || !slices.Equal(rules["GET /users"], want["GET /users"]) {
+		t.Errorf("rules() = %v, want %v", rules, want)
+	}
+	if snapshot := l.snapshot()["GET /users"]; snapshot.Observations != 5 || snapshot.Differences["body/name"] != 1 {
+		t.Errorf("snapshot() = %+v, want 5 observations and body/name differing once", snapshot)
+	}
+}
+
+func TestLearner_maxRoutes(t *testing.T) {
+	l := newLearner()
+	if err := l.configure(&LearnConfig{MaxRoutes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, dropped := l.observe("GET /users", nil); dropped != 0 {
+		t.Errorf("observe() dropped = %d, want the first route learned", dropped)
+	}
+	for want := 1; want <= 2; want++ {
+		if _, dropped := l.observe("GET /orders", nil); dropped != want {
+			t.Errorf("observe() dropped = %d, want %d", dropped, want)
+		}
+	}
+	if _, dropped := l.observe("GET /users", nil); dropped != 0 {
+		t.Errorf("observe() dropped = %d, want known routes still learned", dropped)
+	}
+	if snapshot := l.snapshot(); len(snapshot) != 1 {
+		t.Errorf("snapshot() = %v, want only the first route", snapshot)
+	}
+}
+
+func TestLearner_configure(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  LearnConfig
+	}{
+		{name: "negative min_observations", cfg: LearnConfig{MinObservations: -1}},
+		{name: "threshold above 1", cfg: LearnConfig{Threshold: 1.5}},
+		{name: "negative max_routes", cfg: LearnConfig{MaxRoutes: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := newLearner().configure(&tt.cfg); err == nil {
+				t.Errorf("configure() should fail")
+			}
+		})
+	}
+}
+
+func TestFieldMatches(t *testing.T) {
+	tests := []struct {
+		rule, field string
+		want        bool
+	}{
+		{rule: "body/at", field: "body/at", want: true},
+		{rule: "body/meta", field: "body/meta/at", want: true},
+		{rule: "body/meta", field: "body/metadata", want: false},
+		{rule: "body/at", field: "body", want: false},
+	}
+	for _, tt := range tests {
+		if got := fieldMatches(tt.rule, tt.field); got != tt.want {
+			t.Errorf("fieldMatches(%q, %q) = %v, want %v", tt.rule, tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestHandler_compareBody_ignoreFields(t *testing.T) {
+	logs := make(logWriter, 10)
+	h := &Handler{
+		slogger:      slog.New(slog.NewTextHandler(logs, nil)),
+		IgnoreFields: map[string][]string{"*": {"body/at"}, "GET /users": {"body/meta"}},
+	}
+	tg := &target{name: "shadow", ComparisonConfig: ComparisonConfig{CompareBody: true}}
+
+	compareAndReport(h, tg, "GET /users", response{body: []byte(`{"at":1,"meta":{"etag":"a"},"id":1}`)}, response{body: []byte(`{"at":2,"meta":{"etag":"b"},"id":1}`)})
+	compareAndReport(h, tg, "GET /orders", response{body: []byte(`{"at":1,"meta":{"etag":"a"}}`)}, response{body: []byte(`{"at":2,"meta":{"etag":"b"}}`)})
+	close(logs)
+
+	var got []string
+	for line := range logs {
+		got = append(got, line)
+	}
+	if len(got) != 1 || !strings.Contains(got[0], "msg=shadow_mismatch") || !strings.Contains(got[0], "ignored=[body/at]") {
+		t.Errorf("only GET /orders should mismatch, with body/at ignored, logged %v", got)
+	}
+}
+
+func TestHandler_compareBody_learnRoutesFull(t *testing.T) {
+	logs := make(logWriter, 10)
+	h := &Handler{
+		slogger: slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Learn:   &LearnConfig{MaxRoutes: 1},
+		learner: newLearner(),
+	}
+	if err := h.learner.configure(h.Learn); err != nil {
+		t.Fatal(err)
+	}
+	tg := &target{name: "shadow", ComparisonConfig: ComparisonConfig{CompareBody: true}}
+	h.targets = []*target{tg}
+	withMetrics(t, h)
+
+	same := response{body: []byte(`{"id":1}`)}
+	for _, route := range []string{"GET /users/1", "GET /users/2", "GET /users/3"} {
+		compareAndReport(h, tg, route, same, same)
+	}
+	close(logs)
+
+	var got []string
+	for line := range logs {
+		if strings.Contains(line, "msg=shadow_learn_route_dropped") {
+			got = append(got, line)
+		}
+	}
+	if len(got) != 2 || !strings.Contains(got[0], "level=WARN") || !strings.Contains(got[1], "level=DEBUG") {
+		t.Errorf("dropped routes should be warned about once, then logged at debug, logged %v", got)
+	}
+	if dropped := testutil.ToFloat64(h.metrics.learnDropped); dropped != 2 {
+		t.Errorf("learn dropped = %v, want 2", dropped)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	l, _, _ := learners.LoadOrNew("admin_test", func() (caddy.Destructor, error) { return newLearner(), nil })
+	defer learners.Delete("admin_test")
+	_ = l.(*learner).configure(&LearnConfig{MinObservations: 1})
+	l.(*learner).observe("GET /users", []string{"body/at"})
+
+	var a adminAPI
+	w := httptest.NewRecorder()
+	if err := a.handleIgnoreFields(w, httptest.NewRequest(http.MethodGet, "/shadow/learned/ignore_fields", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var rules map[string]map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &rules); err != nil {
+		t.Fatal(err)
+	}
+	if got := rules["admin_test"]["GET /users"]; !slices.Equal(got, []string{"body/at"}) {
+		t.Errorf("ignore_fields = %v, want body/at for GET /users", rules)
+	}
+
+	w = httptest.NewRecorder()
+	if err := a.handleLearned(w, httptest.NewRequest(http.MethodGet, "/shadow/learned", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.Body.String(), `"observations":1`) {
+		t.Errorf("learned = %s, want the observations for GET /users", w.Body)
+	}
+
+	if err := a.handleLearned(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/shadow/learned", nil)); err == nil {
+		t.Errorf("POST should not be allowed")
+	}
+}
@@ -0,0 +1,75 @@
+package shadow
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	dropReasonMaxInFlight  = "max_in_flight"
+	dropReasonMaxRate      = "max_rate"
+	dropReasonBodyTooLarge = "body_too_large"
+)
+
+// acquire reserves a slot in the target's shadow budget. If the budget is used up, it returns the reason the request should be
+// dropped. Otherwise it returns an empty string, and the slot must be given back with release once the shadowed
+// request has finished. The ticket is the one the outcome of the request is recorded with in the target's breaker.
+func (t *target) acquire() (ticket breakerTicket, dropReason string) {
+	if t.maxInFlight > 0 {
+		if t.inFlight.Add(1) > int64(t.maxInFlight) {
+			t.inFlight.Add(-1)
+			return 0, dropReasonMaxInFlight
+		}
+	}
+
+	if t.limiter != nil && !t.limiter.Allow() {
+		t.release()
+		return 0, dropReasonMaxRate
+	}
+
+	// The breaker goes last, since a half-open breaker lets its probe request through at most once
+	if t.breaker != nil {
+		var ok bool
+		if ticket, ok = t.breaker.allow(); !ok {
+			t.release()
+			return 0, dropReasonCircuitOpen
+		}
+	}
+
+	return ticket, ""
+}
+
+func (t *target) release() {
+	if t.maxInFlight > 0 {
+		t.inFlight.Add(-1)
+	}
+}
+
+// parseRate parses a rate like "200/s", "1000/m" or "5/100ms" into a token bucket limiter. The bucket holds at most
+// one interval's worth of tokens.
+func parseRate(s string) (*rate.Limiter, error) {
+	countStr, intervalStr, ok := strings.Cut(s, "/")
+	if !ok {
+		return nil, fmt.Errorf("rate %q must be in the form <count>/<interval>", s)
+	}
+
+	count, err := strconv.ParseFloat(countStr, 64)
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("rate %q must have a positive count", s)
+	}
+
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil {
+		// Allow bare units, like "s" or "m", as shorthand for a single unit
+		interval, err = time.ParseDuration("1" + intervalStr)
+	}
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("rate %q must have a positive interval", s)
+	}
+
+	return rate.NewLimiter(rate.Limit(count/interval.Seconds()), max(1, int(count))), nil
+}
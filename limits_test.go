@@ -0,0 +1,72 @@
+package shadow
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      string
+		wantLimit rate.Limit
+		wantBurst int
+		wantErr   bool
+	}{
+		{name: "per second", rate: "200/s", wantLimit: 200, wantBurst: 200},
+		{name: "per minute", rate: "60/m", wantLimit: 1, wantBurst: 60},
+		{name: "per duration", rate: "5/100ms", wantLimit: 50, wantBurst: 5},
+		{name: "fractional", rate: "0.5/s", wantLimit: 0.5, wantBurst: 1},
+		{name: "missing interval", rate: "200", wantErr: true},
+		{name: "bad count", rate: "many/s", wantErr: true},
+		{name: "zero count", rate: "0/s", wantErr: true},
+		{name: "bad interval", rate: "200/fortnight", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRate(tt.rate)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Limit() != tt.wantLimit || got.Burst() != tt.wantBurst {
+				t.Errorf("parseRate() = %v/%d, want %v/%d", got.Limit(), got.Burst(), tt.wantLimit, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestTarget_acquire(t *testing.T) {
+	t.Run("max in flight", func(t *testing.T) {
+		tg := &target{maxInFlight: 2}
+		for i := range 2 {
+			if _, reason := tg.acquire(); reason != "" {
+				t.Fatalf("acquire() %d = %q, want a slot", i, reason)
+			}
+		}
+		if _, reason := tg.acquire(); reason != dropReasonMaxInFlight {
+			t.Errorf("acquire() = %q, want %q", reason, dropReasonMaxInFlight)
+		}
+		tg.release()
+		if _, reason := tg.acquire(); reason != "" {
+			t.Errorf("acquire() after release = %q, want a slot", reason)
+		}
+	})
+
+	t.Run("max rate", func(t *testing.T) {
+		tg := &target{maxInFlight: 10, limiter: rate.NewLimiter(rate.Every(time.Hour), 1)}
+		if _, reason := tg.acquire(); reason != "" {
+			t.Fatalf("acquire() = %q, want a slot", reason)
+		}
+		if _, reason := tg.acquire(); reason != dropReasonMaxRate {
+			t.Errorf("acquire() = %q, want %q", reason, dropReasonMaxRate)
+		}
+		if n := tg.inFlight.Load(); n != 1 {
+			t.Errorf("in flight = %d, want the rate limited request to give its slot back", n)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package shadow
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	placeholderRole      = "http.shadow.role"
+	placeholderRequestID = "http.shadow.request_id"
+)
+
+// requestID returns the ID shared by the primary and shadowed copies of a request. An ID sent by the client in the
+// request ID header is reused, so it can be traced through both backends.
+func (h *Handler) requestID(r *http.Request) string {
+	if h.RequestIDHeader != "" {
+		if id := r.Header.Get(h.RequestIDHeader); id != "" {
+			return id
+		}
+	}
+	return uuid.NewString()
+}
+
+// markPrimary sets the placeholders and headers which tell the primary copy of a request apart from the shadowed
+// copies.
+func (h *Handler) markPrimary(pr *http.Request, requestID string) {
+	if repl, ok := pr.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set(placeholderRole, "primary")
+		repl.Set(placeholderRequestID, requestID)
+	}
+
+	if h.RequestIDHeader != "" {
+		pr.Header.Set(h.RequestIDHeader, requestID)
+	}
+}
+
+// markShadow sets the placeholders and headers which tell a shadowed copy of a request apart from the primary. The
+// shadowed copy gets its own replacer, so placeholders set while handling the shadow don't leak into the primary or
+// other targets. It returns the shadowed request to use from here on.
+func (h *Handler) markShadow(sr *http.Request, t *target, requestID string) *http.Request {
+	sr = withOwnReplacer(sr)
+	if repl, ok := sr.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		role := "shadow"
+		if t == h.secondary {
+			role = "secondary"
+		}
+		repl.Set(placeholderRole, role)
+		repl.Set(placeholderRequestID, requestID)
+		repl.Set(placeholderTarget, t.name)
+	}
+
+	if h.RequestIDHeader != "" {
+		sr.Header.Set(h.RequestIDHeader, requestID)
+	}
+	if h.ShadowHeader != "" {
+		value := h.ShadowHeaderValue
+		if value == "" {
+			value = "1"
+		}
+		sr.Header.Set(h.ShadowHeader, value)
+	}
+	if h.isDryRun(sr) {
+		value := h.DryRunHeaderValue
+		if value == "" {
+			value = "1"
+		}
+		sr.Header.Set(h.dryRunHeader(), value)
+	}
+
+	return sr
+}
+
+// withOwnReplacer gives a copy of a request its own replacer, layered over the original, so placeholders set while
+// handling it don't leak into other copies of the request
+func withOwnReplacer(r *http.Request) *http.Request {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return r
+	}
+	own := caddy.NewEmptyReplacer()
+	own.Map(repl.Get)
+	return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, own))
+}
+
+func (h *Handler) dryRunHeader() string {
+	if h.DryRunHeader == "" {
+		return "X-Shadow-Dry-Run"
+	}
+	return h.DryRunHeader
+}
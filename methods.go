@@ -0,0 +1,77 @@
+package shadow
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	unsafeMethodsBlock  = "block"
+	unsafeMethodsAllow  = "allow"
+	unsafeMethodsDryRun = "dry_run"
+)
+
+// isSafeMethod reports whether the method is one that shouldn't have side effects, and so is always safe to mirror
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// provisionUnsafeMethods checks the policy for unsafe methods. Unsafe methods are only ever mirrored when unsafe_match
+// opts them in, so a policy which mirrors them without it is a mistake.
+func (h *Handler) provisionUnsafeMethods() error {
+	switch h.UnsafeMethods {
+	case "", unsafeMethodsBlock:
+	case unsafeMethodsAllow, unsafeMethodsDryRun:
+		if len(h.UnsafeMatchRaw) == 0 {
+			return fmt.Errorf("unsafe_methods %s requires unsafe_match, to opt in the requests which are safe to mirror",
+				h.UnsafeMethods)
+		}
+	default:
+		return fmt.Errorf("unsafe_methods must be %q, %q or %q, got %q",
+			unsafeMethodsBlock, unsafeMethodsAllow, unsafeMethodsDryRun, h.UnsafeMethods)
+	}
+	return nil
+}
+
+// methodAllowed applies the policy for unsafe methods. Safe methods are always mirrored. Unsafe methods are only
+// mirrored when the policy is "allow" or "dry_run" and the request matches unsafe_match. Without any unsafe_match
+// matchers, nothing is opted in.
+func (h *Handler) methodAllowed(r *http.Request) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+
+	allowed := (h.UnsafeMethods == unsafeMethodsAllow || h.UnsafeMethods == unsafeMethodsDryRun) && len(h.unsafeMatch) > 0
+	if allowed {
+		var err error
+		allowed, err = h.unsafeMatch.AnyMatchWithError(r)
+		if err != nil {
+			h.slogger.Error("shadow_unsafe_match_error", slog.String("error", err.Error()))
+			allowed = false
+		}
+	}
+
+	if !allowed && h.MetricsName != "" {
+		h.metrics.methodSkipped.WithLabelValues(methodLabel(r.Method)).Inc()
+	}
+	return allowed
+}
+
+// isDryRun reports whether the shadowed copy of the request should be marked as a dry run
+func (h *Handler) isDryRun(r *http.Request) bool {
+	return h.UnsafeMethods == unsafeMethodsDryRun && !isSafeMethod(r.Method)
+}
+
+// methodLabel keeps the cardinality of the method metric label bounded, no matter what clients send
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
@@ -0,0 +1,85 @@
+package shadow
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestHandler_methodAllowed(t *testing.T) {
+	idempotent := caddyhttp.MatcherSets{caddyhttp.MatcherSet{caddyhttp.MatchPath{"/idempotent/*"}}}
+	tests := []struct {
+		name        string
+		policy      string
+		unsafeMatch caddyhttp.MatcherSets
+		method      string
+		path        string
+		want        bool
+	}{
+		{name: "safe method", method: "GET", path: "/", want: true},
+		{name: "blocked by default", method: "POST", path: "/", want: false},
+		{name: "blocked", policy: unsafeMethodsBlock, method: "DELETE", path: "/", want: false},
+		{name: "allowed without unsafe_match", policy: unsafeMethodsAllow, method: "POST", path: "/", want: false},
+		{name: "dry run without unsafe_match", policy: unsafeMethodsDryRun, method: "PUT", path: "/", want: false},
+		{name: "opted in", policy: unsafeMethodsAllow, unsafeMatch: idempotent, method: "POST", path: "/idempotent/a", want: true},
+		{name: "opted in as a dry run", policy: unsafeMethodsDryRun, unsafeMatch: idempotent, method: "PUT", path: "/idempotent/a", want: true},
+		{name: "not opted in", policy: unsafeMethodsAllow, unsafeMatch: idempotent, method: "POST", path: "/orders", want: false},
+		{name: "safe method without opt in", policy: unsafeMethodsAllow, unsafeMatch: idempotent, method: "HEAD", path: "/orders", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{
+				UnsafeMethods: tt.policy,
+				unsafeMatch:   tt.unsafeMatch,
+				slogger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			r := prepareRequest(httptest.NewRequest(tt.method, tt.path, nil))
+			if got := h.methodAllowed(r); got != tt.want {
+				t.Errorf("methodAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_provisionUnsafeMethods(t *testing.T) {
+	matchAll := caddy.ModuleMap{"path": json.RawMessage(`["/*"]`)}
+	tests := []struct {
+		name    string
+		h       Handler
+		wantErr bool
+	}{
+		{name: "default", h: Handler{}},
+		{name: "block", h: Handler{UnsafeMethods: unsafeMethodsBlock}},
+		{name: "allow with unsafe_match", h: Handler{UnsafeMethods: unsafeMethodsAllow, UnsafeMatchRaw: caddyhttp.RawMatcherSets{matchAll}}},
+		{name: "dry run with unsafe_match", h: Handler{UnsafeMethods: unsafeMethodsDryRun, UnsafeMatchRaw: caddyhttp.RawMatcherSets{matchAll}}},
+		{name: "allow without unsafe_match", h: Handler{UnsafeMethods: unsafeMethodsAllow}, wantErr: true},
+		{name: "dry run without unsafe_match", h: Handler{UnsafeMethods: unsafeMethodsDryRun}, wantErr: true},
+		{name: "unknown policy", h: Handler{UnsafeMethods: "sometimes"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.h.provisionUnsafeMethods(); (err != nil) != tt.wantErr {
+				t.Errorf("provisionUnsafeMethods() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// allowUnsafeMethods sets the unsafe method policy, opting in every request
+func allowUnsafeMethods(h *Handler, policy string) {
+	h.UnsafeMethods = policy
+	h.unsafeMatch = caddyhttp.MatcherSets{caddyhttp.MatcherSet{caddyhttp.MatchPath{"/*"}}}
+}
+
+func TestMethodLabel(t *testing.T) {
+	for method, want := range map[string]string{"POST": "POST", "DELETE": "DELETE", "PROPFIND": "OTHER", "x\x00": "OTHER"} {
+		if got := methodLabel(method); got != want {
+			t.Errorf("methodLabel(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
@@ -9,43 +9,202 @@ import (
 )
 
 type metrics struct {
-	ttfb            map[string]prometheus.Histogram
-	totalTime       map[string]prometheus.Histogram
-	match, mismatch prometheus.Counter
+	primary roleMetrics
+
+	// Everything about shadowed requests is labelled by target
+	shadowTTFB          *prometheus.HistogramVec
+	shadowTotalTime     *prometheus.HistogramVec
+	shadowTimeouts      *prometheus.CounterVec
+	shadowCancellations *prometheus.CounterVec
+	match, mismatch     *prometheus.CounterVec
+	noise               *prometheus.CounterVec
+	sampled             *prometheus.CounterVec
+	skipped             *prometheus.CounterVec
+	dropped             *prometheus.CounterVec
+	circuitState        *prometheus.GaugeVec
+	effectiveRate       *prometheus.GaugeVec
+
+	methodSkipped *prometheus.CounterVec
+	overhead      prometheus.Histogram
+	served        *prometheus.CounterVec
+	learnDropped  prometheus.Counter
+}
+
+// roleMetrics are the timing metrics shared by the primary and each shadow target
+type roleMetrics struct {
+	ttfb, totalTime         prometheus.Observer
+	timeouts, cancellations prometheus.Counter
+}
+
+// targetMetrics are the metrics for a single shadow target
+type targetMetrics struct {
+	roleMetrics
+	match, mismatch  prometheus.Counter
+	noise            prometheus.Counter
+	sampled, skipped prometheus.Counter
+	dropped          *prometheus.CounterVec
+	circuitState     prometheus.Gauge
+	effectiveRate    prometheus.Gauge
 }
 
 const millisecond = float64(time.Millisecond) / float64(time.Second)
 
 func (m *metrics) provision(ctx caddy.Context, name string) {
-	m.ttfb = make(map[string]prometheus.Histogram, 2)
-	m.ttfb["primary"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+	primaryTTFB := prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: name,
 		Name:      "primary_time_to_first_byte_seconds",
 		Help:      "Number of milliseconds before first byte of response from primary",
 		Buckets:   prometheus.ExponentialBuckets(millisecond, 2, 16),
 	})
-	ctx.GetMetricsRegistry().Register(m.ttfb["primary"])
-	m.ttfb["shadow"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+	ctx.GetMetricsRegistry().Register(primaryTTFB)
+	m.shadowTTFB = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: name,
 		Name:      "shadow_time_to_first_byte_seconds",
 		Help:      "Number of milliseconds before first byte of response from shadow",
 		Buckets:   prometheus.ExponentialBuckets(millisecond, 2, 16),
-	})
-	ctx.GetMetricsRegistry().Register(m.ttfb["shadow"])
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.shadowTTFB)
 
-	m.totalTime = make(map[string]prometheus.Histogram, 2)
-	m.totalTime["primary"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+	primaryTotalTime := prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: name,
 		Name:      "primary_total_time_seconds",
 		Help:      "Number of milliseconds for full response from primary",
 		Buckets:   prometheus.ExponentialBuckets(millisecond*2, 2, 16),
 	})
-	ctx.GetMetricsRegistry().Register(m.totalTime["primary"])
-	m.totalTime["shadow"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+	ctx.GetMetricsRegistry().Register(primaryTotalTime)
+	m.shadowTotalTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: name,
 		Name:      "shadow_total_time_seconds",
 		Help:      "Number of milliseconds for full response from shadow",
 		Buckets:   prometheus.ExponentialBuckets(millisecond*2, 2, 16),
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.shadowTotalTime)
+
+	primaryTimeouts := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "primary_timeouts_total",
+		Help:      "Number of primary requests which hit primary_timeout",
 	})
-	ctx.GetMetricsRegistry().Register(m.totalTime["shadow"])
+	ctx.GetMetricsRegistry().Register(primaryTimeouts)
+	m.shadowTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_timeouts_total",
+		Help:      "Number of shadow requests which hit shadow_timeout",
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.shadowTimeouts)
+
+	primaryCancellations := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "primary_cancellations_total",
+		Help:      "Number of primary requests cut short because the client went away",
+	})
+	ctx.GetMetricsRegistry().Register(primaryCancellations)
+	m.shadowCancellations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_cancellations_total",
+		Help:      "Number of shadow requests cut short because the client went away",
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.shadowCancellations)
+
+	m.primary = roleMetrics{
+		ttfb:          primaryTTFB,
+		totalTime:     primaryTotalTime,
+		timeouts:      primaryTimeouts,
+		cancellations: primaryCancellations,
+	}
+
+	m.match = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_body_match",
+		Help:      "Number of responses that matched",
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.match)
+	m.mismatch = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_body_mismatch",
+		Help:      "Number of responses that did not match",
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.mismatch)
+	m.noise = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_body_noise",
+		Help:      "Number of responses that only differed in fields learned as noise from the secondary",
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.noise)
+
+	m.sampled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_sampled_total",
+		Help:      "Number of requests which were mirrored to the shadow",
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.sampled)
+	m.skipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_skipped_total",
+		Help:      "Number of requests which were not mirrored to the shadow",
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.skipped)
+	m.dropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_dropped_total",
+		Help:      "Number of sampled requests which were not mirrored to the shadow, by reason",
+	}, []string{"target", "reason"})
+	ctx.GetMetricsRegistry().Register(m.dropped)
+	m.circuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: name,
+		Name:      "shadow_circuit_state",
+		Help:      "State of the shadow circuit breaker: 0 is closed, 1 is half-open, 2 is open",
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.circuitState)
+	m.overhead = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: name,
+		Name:      "shadow_overhead_seconds",
+		Help:      "Time shadowing added to the primary path, outside of the primary handler itself",
+		Buckets:   prometheus.ExponentialBuckets(millisecond/100, 2, 16),
+	})
+	ctx.GetMetricsRegistry().Register(m.overhead)
+	m.effectiveRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: name,
+		Name:      "shadow_effective_sample_rate",
+		Help:      "Sample rate currently in effect, after any automatic back-off",
+	}, []string{"target"})
+	ctx.GetMetricsRegistry().Register(m.effectiveRate)
+	m.methodSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_method_skipped_total",
+		Help:      "Number of requests which were not mirrored because of the unsafe method policy, by method",
+	}, []string{"method"})
+	ctx.GetMetricsRegistry().Register(m.methodSkipped)
+	m.served = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_served_total",
+		Help:      "Number of responses sent to the client when the shadow's response may be served, by the role which served them",
+	}, []string{"role"})
+	ctx.GetMetricsRegistry().Register(m.served)
+	m.learnDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "shadow_learn_dropped_total",
+		Help:      "Number of comparisons not learned from, because they were for a new route once max_routes was reached",
+	})
+	ctx.GetMetricsRegistry().Register(m.learnDropped)
+}
+
+// forTarget returns the metrics labelled for a single shadow target
+func (m *metrics) forTarget(name string) targetMetrics {
+	return targetMetrics{
+		roleMetrics: roleMetrics{
+			ttfb:          m.shadowTTFB.WithLabelValues(name),
+			totalTime:     m.shadowTotalTime.WithLabelValues(name),
+			timeouts:      m.shadowTimeouts.WithLabelValues(name),
+			cancellations: m.shadowCancellations.WithLabelValues(name),
+		},
+		match:         m.match.WithLabelValues(name),
+		mismatch:      m.mismatch.WithLabelValues(name),
+		noise:         m.noise.WithLabelValues(name),
+		sampled:       m.sampled.WithLabelValues(name),
+		skipped:       m.skipped.WithLabelValues(name),
+		dropped:       m.dropped.MustCurryWith(prometheus.Labels{"target": name}),
+		circuitState:  m.circuitState.WithLabelValues(name),
+		effectiveRate: m.effectiveRate.WithLabelValues(name),
+	}
 }
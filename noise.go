@@ -0,0 +1,205 @@
+package shadow
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+const (
+	bodyField   = "body"
+	statusField = "status"
+
+	// minNoiseDifferences is how many times a field has to differ between the primary and the secondary, for the
+	// same route, before it's treated as noise. A single flaky response doesn't hide real regressions.
+	minNoiseDifferences = 3
+
+	// maxNoiseFields bounds the memory used for learned noise, no matter how varied the routes and responses are
+	maxNoiseFields = 4096
+)
+
+// noise is the set of response fields which have been seen to differ between the primary and the secondary, by route.
+// Since both run the same code, differences in these fields come from nondeterminism (timestamps, random IDs, map
+// ordering) rather than regressions, so they're left out when comparing the primary with a shadow.
+type noise struct {
+	mu sync.RWMutex
+
+	// differences counts how many times each field has differed, by route. size is the number of fields counted,
+	// across every route.
+	differences map[string]map[string]int
+	size        int
+}
+
+func newNoise() *noise {
+	return &noise{differences: make(map[string]map[string]int)}
+}
+
+// learn counts the fields which differed for the route, and returns the fields which have just become noise
+func (n *noise) learn(route string, fields []string) (learned []string) {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	counts := n.differences[route]
+	for _, field := range fields {
+		if _, ok := counts[field]; !ok {
+			if n.size >= maxNoiseFields {
+				continue
+			}
+			if counts == nil {
+				counts = make(map[string]int)
+				n.differences[route] = counts
+			}
+			n.size++
+		}
+		counts[field]++
+		if counts[field] == minNoiseDifferences {
+			learned = append(learned, field)
+		}
+	}
+	return learned
+}
+
+// has reports whether a field is known to be noise for the route. It's safe to call on a nil noise, which has no
+// fields.
+func (n *noise) has(route, field string) bool {
+	if n == nil {
+		return false
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.differences[route][field] >= minNoiseDifferences
+}
+
+// split separates fields which differ between the primary and a shadow into real regressions and noise
+func (n *noise) split(route string, fields []string) (regressions, noisy []string) {
+	for _, field := range fields {
+		if n.has(route, field) {
+			noisy = append(noisy, field)
+		} else {
+			regressions = append(regressions, field)
+		}
+	}
+	return regressions, noisy
+}
+
+// response is a finished response, as captured by a recorder
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+
+	// digests holds the hashes of the body, when it was hashed as it was written rather than buffered. hashOnly
+	// records that the body was too large to capture, so it can only be compared by hash.
+	digests  *bodyDigests
+	hashOnly bool
+}
+
+// fieldDiffs returns the fields which differ between two responses, limited to what's being compared
+func (c *ComparisonConfig) fieldDiffs(a, b response) []string {
+	diffs := c.responseBodyDiffs(a, b)
+	for _, k := range c.CompareHeaders {
+		if !slices.Equal(a.header.Values(k), b.header.Values(k)) {
+			diffs = append(diffs, headerField(k))
+		}
+	}
+	if c.CompareStatus && a.status != b.status {
+		diffs = append(diffs, statusField)
+	}
+	return diffs
+}
+
+// responseBodyDiffs returns the fields which differ between the primary's body and another response's. A body compared
+// by hash is a single field.
+func (c *ComparisonConfig) responseBodyDiffs(a, b response) []string {
+	if algorithm := c.bodyHash(a); algorithm != "" {
+		if a.bodyDigest(algorithm).equal(b.bodyDigest(algorithm)) {
+			return nil
+		}
+		return []string{bodyField}
+	}
+	return c.bodyDiffs(a.body, b.body)
+}
+
+// bodyDiffs returns the fields which differ between two response bodies. With jq queries, each query which selects
+// different results is a field. Otherwise, bodies are only equal if they're the same byte for byte, the same as
+// compare_body without any ignore rules or noise. When they aren't, JSON bodies are compared field by field to find
+// what differs, and a body which isn't JSON, or only differs in formatting or key order, is a single field.
+func (c *ComparisonConfig) bodyDiffs(a, b []byte) (diffs []string) {
+	if len(c.compareJQ) > 0 {
+		var av, bv any
+		_ = json.Unmarshal(a, &av)
+		_ = json.Unmarshal(b, &bv)
+		for i, jq := range c.compareJQ {
+			if !jqEqual(jq, av, bv) {
+				diffs = append(diffs, "jq/"+string(c.CompareJQ[i]))
+			}
+		}
+		return diffs
+	}
+
+	if bytes.Equal(a, b) {
+		return nil
+	}
+
+	var av, bv any
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return []string{bodyField}
+	}
+	diffs = jsonDiffs(bodyField, av, bv, nil)
+	if len(diffs) == 0 {
+		return []string{bodyField}
+	}
+	slices.Sort(diffs)
+	return slices.Compact(diffs)
+}
+
+// jsonDiffs appends the paths of the fields which differ between two decoded JSON values. Array indexes are
+// generalized to "*", so noise learned from one element of an array applies to all of them.
+func jsonDiffs(path string, a, b any, diffs []string) []string {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			return append(diffs, path)
+		}
+		for k, v := range av {
+			if w, ok := bv[k]; ok {
+				diffs = jsonDiffs(path+"/"+k, v, w, diffs)
+			} else {
+				diffs = append(diffs, path+"/"+k)
+			}
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				diffs = append(diffs, path+"/"+k)
+			}
+		}
+	case []any:
+		bv, ok := b.([]any)
+		if !ok {
+			return append(diffs, path)
+		}
+		if len(av) != len(bv) {
+			diffs = append(diffs, path)
+		}
+		for i := range min(len(av), len(bv)) {
+			diffs = jsonDiffs(path+"/*", av[i], bv[i], diffs)
+		}
+	default:
+		if a != b {
+			diffs = append(diffs, path)
+		}
+	}
+	return diffs
+}
+
+func headerField(name string) string {
+	return "header/" + http.CanonicalHeaderKey(name)
+}
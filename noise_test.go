@@ -0,0 +1,153 @@
+package shadow
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestComparisonConfig_bodyDiffs(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		jq   []JQQuery
+		want []string
+	}{
+		{name: "equal", a: `{"id":1}`, b: `{"id":1}`, want: nil},
+		{name: "reformatted json", a: `{"id":1,"name":"a"}`, b: `{ "name": "a", "id": 1 }`, want: []string{"body"}},
+		{name: "not json", a: `primary`, b: `shadow`, want: []string{"body"}},
+		{name: "field", a: `{"id":1,"name":"a"}`, b: `{"id":2,"name":"a"}`, want: []string{"body/id"}},
+		{name: "missing field", a: `{"id":1,"at":"now"}`, b: `{"id":1}`, want: []string{"body/at"}},
+		{name: "added field", a: `{"id":1}`, b: `{"id":1,"at":"now"}`, want: []string{"body/at"}},
+		{name: "type change", a: `{"id":{"a":1}}`, b: `{"id":"1"}`, want: []string{"body/id"}},
+		{
+			name: "array elements",
+			a:    `{"items":[{"id":1,"at":1},{"id":2,"at":2}]}`,
+			b:    `{"items":[{"id":1,"at":3},{"id":2,"at":4}]}`,
+			want: []string{"body/items/*/at"},
+		},
+		{name: "array length", a: `[1,2]`, b: `[1]`, want: []string{"body"}},
+		{name: "jq", a: `{"id":1,"at":1}`, b: `{"id":1,"at":2}`, jq: []JQQuery{".id", ".at"}, want: []string{"jq/.at"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ComparisonConfig{CompareJQ: tt.jq}
+			if err := c.provision(); err != nil {
+				t.Fatalf("provision() error = %v", err)
+			}
+			if got := c.bodyDiffs([]byte(tt.a), []byte(tt.b)); !slices.Equal(got, tt.want) {
+				t.Errorf("bodyDiffs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComparisonConfig_fieldDiffs(t *testing.T) {
+	c := &ComparisonConfig{
+		CompareStatus:  true,
+		CompareHeaders: []string{"x-request-time", "Content-Type"},
+	}
+	a := response{status: 200, header: http.Header{"X-Request-Time": {"1"}, "Content-Type": {"application/json"}}}
+	b := response{status: 500, header: http.Header{"X-Request-Time": {"2"}, "Content-Type": {"application/json"}}}
+
+	want := []string{"header/X-Request-Time", "status"}
+	if got := c.fieldDiffs(a, b); !slices.Equal(got, want) {
+		t.Errorf("fieldDiffs() = %v, want %v", got, want)
+	}
+}
+
+func TestNoise(t *testing.T) {
+	n := newNoise()
+	for range minNoiseDifferences - 1 {
+		if learned := n.learn("GET /users", []string{"body/id", "body/at"}); learned != nil {
+			t.Errorf("learn() = %v, want nothing until the fields have differed %d times", learned, minNoiseDifferences)
+		}
+	}
+	if learned := n.learn("GET /users", []string{"body/id", "body/at"}); !slices.Equal(learned, []string{"body/id", "body/at"}) {
+		t.Errorf("learn() = %v, want both fields", learned)
+	}
+	if learned := n.learn("GET /users", []string{"body/id"}); learned != nil {
+		t.Errorf("learn() = %v, want nothing new", learned)
+	}
+
+	regressions, noisy := n.split("GET /users", []string{"body/id", "body/name"})
+	if !slices.Equal(regressions, []string{"body/name"}) || !slices.Equal(noisy, []string{"body/id"}) {
+		t.Errorf("split() = %v, %v, want [body/name], [body/id]", regressions, noisy)
+	}
+	if n.has("GET /orders", "body/id") {
+		t.Errorf("noise learned for one route should not apply to another")
+	}
+
+	var none *noise
+	if none.has("GET /users", "body/id") {
+		t.Errorf("nil noise should not have any fields")
+	}
+}
+
+func TestHandler_compareHeaders(t *testing.T) {
+	logs := make(logWriter, 10)
+	h := &Handler{slogger: slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})), noise: newNoise()}
+	for range minNoiseDifferences {
+		h.noise.learn("GET /", []string{"header/Date"})
+	}
+	tg := &target{name: "shadow", ComparisonConfig: ComparisonConfig{CompareHeaders: []string{"Content-Type", "Date", "Server"}}}
+
+	compareAndReport(h, tg, "GET /",
+		response{header: http.Header{"Content-Type": {"text/plain"}, "Date": {"Mon"}, "Server": {"caddy"}}},
+		response{header: http.Header{"Content-Type": {"text/html"}, "Date": {"Tue"}, "Server": {"caddy"}}},
+	)
+	close(logs)
+
+	var got []string
+	for line := range logs {
+		got = append(got, line)
+	}
+	if len(got) != 2 ||
+		!strings.Contains(got[0], "msg=shadow_header_mismatch") || !strings.Contains(got[0], "key=Content-Type") ||
+		!strings.Contains(got[1], "msg=shadow_header_noise") || !strings.Contains(got[1], "key=Date") {
+		t.Errorf("reportHeaders() should report Content-Type as a mismatch and Date as noise, logged %v", got)
+	}
+}
+
+func TestHandler_compareBody_sameRule(t *testing.T) {
+	// Whether a body matches mustn't depend on whether ignore rules or noise cancellation are configured
+	configs := []struct {
+		name string
+		h    func() *Handler
+	}{
+		{name: "plain", h: func() *Handler { return &Handler{} }},
+		{name: "ignore rules", h: func() *Handler { return &Handler{IgnoreFields: map[string][]string{"*": {"body/at"}}} }},
+		{name: "noise", h: func() *Handler { return &Handler{noise: newNoise()} }},
+	}
+	tests := []struct {
+		name      string
+		primary   string
+		shadow    string
+		wantMatch bool
+	}{
+		{name: "same bytes", primary: `{"a":1,"b":2}`, shadow: `{"a":1,"b":2}`, wantMatch: true},
+		{name: "reordered keys", primary: `{"a":1,"b":2}`, shadow: `{"b":2,"a":1}`},
+		{name: "whitespace", primary: `{"a":1}`, shadow: `{ "a": 1 }`},
+	}
+	for _, cfg := range configs {
+		for _, tt := range tests {
+			t.Run(cfg.name+"/"+tt.name, func(t *testing.T) {
+				h := cfg.h()
+				h.slogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+				tg := &target{name: "shadow", ComparisonConfig: ComparisonConfig{CompareBody: true}}
+				h.targets = []*target{tg}
+				withMetrics(t, h)
+
+				compareAndReport(h, tg, "GET /", response{body: []byte(tt.primary)}, response{body: []byte(tt.shadow)})
+				if match := testutil.ToFloat64(tg.metrics.match) > 0; match != tt.wantMatch {
+					t.Errorf("match = %v, want %v", match, tt.wantMatch)
+				}
+			})
+		}
+	}
+}
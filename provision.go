@@ -2,94 +2,183 @@ package shadow
 
 import (
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
-	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 
-	"github.com/itchyny/gojq"
-
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/dustin/go-humanize"
 )
 
 // Provision implements caddy.Provisioner
 func (h *Handler) Provision(ctx caddy.Context) (err error) {
-	err = h.provisionHandlers(ctx)
+	h.primary, err = loadSubroute(ctx, h.PrimaryRaw)
 	if err != nil {
-		return
+		return fmt.Errorf("error loading primary module: %w", err)
 	}
 
 	h.slogger = ctx.Slogger()
 
 	h.now = time.Now
+	h.random = rand.Float64
 
-	if len(h.CompareJQ) > 0 {
-		h.compareJQ = make([]*gojq.Query, len(h.CompareJQ))
-		for i, qStr := range h.CompareJQ {
-			h.compareJQ[i], err = gojq.Parse(string(qStr))
-			if err != nil {
-				return fmt.Errorf("error parsing jq query %d: %w", i, err)
-			}
-		}
+	err = h.ComparisonConfig.provision()
+	if err != nil {
+		return err
 	}
 
-	h.timeout = 30 * time.Second
-	if h.Timeout != "" {
-		h.timeout, err = time.ParseDuration(h.Timeout)
+	if h.ShadowMatchRaw != nil {
+		var matchers any
+		matchers, err = ctx.LoadModule(h, "ShadowMatchRaw")
 		if err != nil {
-			return fmt.Errorf("error parsing timeout: %w", err)
+			return fmt.Errorf("error loading shadow_match matchers: %w", err)
+		}
+		err = h.shadowMatch.FromInterface(matchers)
+		if err != nil {
+			return fmt.Errorf("error loading shadow_match matchers: %w", err)
 		}
 	}
 
-	if h.MetricsName != "" {
-		// If metrics are enabled, assume that always includes basic performance metrics
-		h.metrics.provision(ctx, h.MetricsName)
+	if h.MaxInFlight < 0 {
+		return fmt.Errorf("max_in_flight must not be negative, got %d", h.MaxInFlight)
 	}
 
-	// Add metrics for comparisons if enabled
-	if h.CompareBody || h.CompareJQ != nil {
-		h.metrics.match = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: h.MetricsName,
-			Name:      "shadow_body_match",
-			Help:      "Number of responses that matched",
-		})
-		h.metrics.mismatch = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: h.MetricsName,
-			Name:      "shadow_body_mismatch",
-			Help:      "Number of responses that did not match",
-		})
-		_ = ctx.GetMetricsRegistry().Register(h.metrics.match)
-		_ = ctx.GetMetricsRegistry().Register(h.metrics.mismatch)
+	h.maxBodySize = 10 << 20
+	if h.MaxBodySize != "" {
+		var size uint64
+		size, err = humanize.ParseBytes(h.MaxBodySize)
+		if err != nil {
+			return fmt.Errorf("error parsing max_body_size: %w", err)
+		}
+		h.maxBodySize = int64(size)
+	}
+	h.maxDecodedSize = 10 << 20
+	if h.MaxDecodedSize != "" {
+		var size uint64
+		size, err = humanize.ParseBytes(h.MaxDecodedSize)
+		if err != nil {
+			return fmt.Errorf("error parsing max_decoded_size: %w", err)
+		}
+		h.maxDecodedSize = int64(size)
+	}
+	h.captureLimit = 1 << 20
+	if h.CaptureLimit != "" {
+		var size uint64
+		size, err = humanize.ParseBytes(h.CaptureLimit)
+		if err != nil {
+			return fmt.Errorf("error parsing capture_limit: %w", err)
+		}
+		h.captureLimit = int64(size)
+	}
+	switch h.LargeBody {
+	case "", largeBodySkip, largeBodySpill:
+	default:
+		return fmt.Errorf("large_body must be %q or %q, got %q", largeBodySkip, largeBodySpill, h.LargeBody)
 	}
 
-	return nil
-}
+	if h.Backoff != nil {
+		h.backoff, err = newBackoff(h.Backoff, h.now)
+		if err != nil {
+			return fmt.Errorf("error provisioning backoff: %w", err)
+		}
+		h.backoff.onChange = h.onBackoffChange
+	}
 
-func (h *Handler) provisionHandlers(ctx caddy.Context) (err error) {
-	var mod any
-	mod, err = ctx.LoadModuleByID("http.handlers.subroute", h.ShadowRaw)
+	err = h.provisionUnsafeMethods()
 	if err != nil {
-		return fmt.Errorf("error loading shadow module: %w", err)
+		return err
 	}
-	h.shadow = mod.(caddyhttp.MiddlewareHandler)
-	mod, err = ctx.LoadModuleByID("http.handlers.subroute", h.PrimaryRaw)
-	if err != nil {
-		return fmt.Errorf("error loading primary module: %w", err)
+	if h.UnsafeMatchRaw != nil {
+		var matchers any
+		matchers, err = ctx.LoadModule(h, "UnsafeMatchRaw")
+		if err != nil {
+			return fmt.Errorf("error loading unsafe_match matchers: %w", err)
+		}
+		err = h.unsafeMatch.FromInterface(matchers)
+		if err != nil {
+			return fmt.Errorf("error loading unsafe_match matchers: %w", err)
+		}
 	}
-	h.primary = mod.(caddyhttp.MiddlewareHandler)
 
-	if provisioner, ok := h.shadow.(caddy.Provisioner); ok {
-		err = provisioner.Provision(ctx)
+	if h.PrimaryTimeout != "" {
+		h.primaryTimeout, err = time.ParseDuration(h.PrimaryTimeout)
 		if err != nil {
-			return fmt.Errorf("error provisioning shadow: %w", err)
+			return fmt.Errorf("error parsing primary_timeout: %w", err)
 		}
 	}
-	if provisioner, ok := h.primary.(caddy.Provisioner); ok {
-		err = provisioner.Provision(ctx)
+
+	if h.Learn != nil {
+		h.learnName = h.Learn.Name
+		if h.learnName == "" {
+			h.learnName = "default"
+		}
+		var l any
+		l, _, err = learners.LoadOrNew(h.learnName, func() (caddy.Destructor, error) {
+			return newLearner(), nil
+		})
+		if err != nil {
+			return fmt.Errorf("error loading learned rules: %w", err)
+		}
+		h.learner = l.(*learner)
+		err = h.learner.configure(h.Learn)
 		if err != nil {
-			return fmt.Errorf("error provisioning shadow: %w", err)
+			return fmt.Errorf("error provisioning learn: %w", err)
+		}
+		if h.RouteKey == "" {
+			// The default key is the raw path, so paths with IDs in them can fill max_routes, and learning stops
+			h.slogger.Warn("shadow_learn_default_route_key",
+				slog.String("route_key", defaultRouteKey),
+			)
 		}
 	}
 
+	if h.MetricsName != "" {
+		// If metrics are enabled, assume that always includes basic performance metrics
+		h.metrics.provision(ctx, h.MetricsName)
+	}
+
+	err = h.provisionTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = h.provisionServe()
+	if err != nil {
+		return err
+	}
+
+	err = h.provisionVerify()
+	if err != nil {
+		return err
+	}
+
+	err = h.provisionDebugHeaders()
+	if err != nil {
+		return err
+	}
+
+	return h.provisionDiffResponse()
+}
+
+// Cleanup implements caddy.CleanerUpper
+func (h *Handler) Cleanup() error {
+	if h.learner != nil {
+		_, err := learners.Delete(h.learnName)
+		return err
+	}
 	return nil
 }
+
+func (h *Handler) onBackoffChange(factor float64, p99 time.Duration, memory uint64) {
+	h.slogger.Info("shadow_backoff_change",
+		slog.Float64("sample_rate_factor", factor),
+		slog.Duration("p99_overhead", p99),
+		slog.Uint64("memory_bytes", memory),
+	)
+	if h.MetricsName != "" {
+		for _, t := range h.targets {
+			t.metrics.effectiveRate.Set(t.sampleRate * factor)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package shadow
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// shadowTargets decides which targets, if any, a request should be mirrored to. It's evaluated before any cloning or
+// body multiplexing takes place, so a request that isn't shadowed costs nothing beyond the primary.
+//
+// For each target returned, a slot in the target's shadow budget has been acquired and must be given back with
+// t.release, and tickets holds the ticket its outcome is recorded with in the target's breaker. When sampleAll is set,
+// sampling is skipped, but the request still has to be eligible and within limits.
+func (h *Handler) shadowTargets(r *http.Request, sampleAll bool) (targets []*target, tickets map[*target]breakerTicket) {
+	eligible := h.matches(r) && h.methodAllowed(r)
+	for _, t := range h.targets {
+		ticket, ok := h.shouldShadow(t, eligible, sampleAll, r)
+		if !ok {
+			continue
+		}
+		targets = append(targets, t)
+		if t.breaker != nil {
+			if tickets == nil {
+				tickets = make(map[*target]breakerTicket, len(h.targets))
+			}
+			tickets[t] = ticket
+		}
+	}
+	return targets, tickets
+}
+
+// shouldShadow makes the sampling decision for a single target, given whether the request is eligible for shadowing
+// at all
+func (h *Handler) shouldShadow(t *target, eligible, sampleAll bool, r *http.Request) (ticket breakerTicket, sampled bool) {
+	sampled = eligible && (sampleAll || h.sample(t, r))
+
+	if sampled && h.LargeBody != largeBodySpill && r.ContentLength > h.maxBodySize {
+		// We already know the body is too large to mirror, so there's no sense in starting the shadowed request
+		sampled = false
+		if h.MetricsName != "" {
+			t.metrics.dropped.WithLabelValues(dropReasonBodyTooLarge).Inc()
+		}
+	}
+
+	if sampled {
+		var reason string
+		if ticket, reason = t.acquire(); reason != "" {
+			sampled = false
+			if h.MetricsName != "" {
+				t.metrics.dropped.WithLabelValues(reason).Inc()
+			}
+		}
+	}
+
+	if h.MetricsName != "" {
+		if sampled {
+			t.metrics.sampled.Inc()
+		} else {
+			t.metrics.skipped.Inc()
+		}
+	}
+
+	return ticket, sampled
+}
+
+// matches reports whether the request is eligible for shadowing according to the configured shadow_match matchers.
+// Without any matchers, every request is eligible.
+func (h *Handler) matches(r *http.Request) bool {
+	match, err := h.shadowMatch.AnyMatchWithError(r)
+	if err != nil {
+		h.slogger.Error("shadow_match_error", slog.String("error", err.Error()))
+		return false
+	}
+	return match
+}
+
+func (h *Handler) sample(t *target, r *http.Request) bool {
+	sampleRate := h.effectiveSampleRate(t)
+
+	// Short-circuit the common 1:1 and 0:1 cases so we don't pay for a random number or a hash
+	if sampleRate >= 1 {
+		return true
+	}
+	if sampleRate <= 0 {
+		return false
+	}
+
+	if t.sampleKey != "" {
+		repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if repl != nil {
+			if key := repl.ReplaceAll(t.sampleKey, ""); key != "" {
+				return keyBucket(key) < sampleRate
+			}
+		}
+		// Requests without a key (missing header, cookie, etc) fall back to random sampling
+	}
+
+	return h.random() < sampleRate
+}
+
+// effectiveSampleRate is the target's configured sample rate, lowered by any automatic back-off
+func (h *Handler) effectiveSampleRate(t *target) float64 {
+	if h.backoff == nil {
+		return t.sampleRate
+	}
+	return h.backoff.rate(t.sampleRate)
+}
+
+// keyBucket hashes a sampling key into a stable bucket in [0, 1). Since it depends only on the key, every Caddy
+// instance makes the same sampling decision for the same key without needing to share any state.
+func keyBucket(key string) float64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+	return float64(hash.Sum64()>>11) / (1 << 53)
+}
@@ -0,0 +1,138 @@
+package shadow
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestHandler_sample(t *testing.T) {
+	type fields struct {
+		sampleRate float64
+		random     float64
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		want   bool
+	}{
+		{
+			name: "mirror everything",
+			fields: fields{
+				sampleRate: 1,
+				random:     0.99,
+			},
+			want: true,
+		},
+		{
+			name: "mirror nothing",
+			fields: fields{
+				sampleRate: 0,
+				random:     0,
+			},
+			want: false,
+		},
+		{
+			name: "inside sample",
+			fields: fields{
+				sampleRate: 0.05,
+				random:     0.01,
+			},
+			want: true,
+		},
+		{
+			name: "outside sample",
+			fields: fields{
+				sampleRate: 0.05,
+				random:     0.05,
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{
+				random: func() float64 { return tt.fields.random },
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			if got := h.sample(&target{sampleRate: tt.fields.sampleRate}, r); got != tt.want {
+				t.Errorf("sample() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_sample_key(t *testing.T) {
+	h := &Handler{
+		random: func() float64 { t.Fatal("keyed sampling should not use random()"); return 0 },
+	}
+	tg := &target{sampleRate: 0.25, sampleKey: "{http.request.header.X-User-ID}"}
+
+	sampled := 0
+	for i := range 10000 {
+		user := fmt.Sprintf("user-%d", i)
+		first := h.sample(tg, requestWithUser(user))
+		if again := h.sample(tg, requestWithUser(user)); again != first {
+			t.Fatalf("sample() for %s changed from %v to %v", user, first, again)
+		}
+		if first {
+			sampled++
+		}
+	}
+
+	if sampled < 2300 || sampled > 2700 {
+		t.Errorf("sample() selected %d of 10000 keys, want roughly 2500", sampled)
+	}
+}
+
+func TestHandler_sample_missingKey(t *testing.T) {
+	h := &Handler{
+		random: func() float64 { return 0.1 },
+	}
+	tg := &target{sampleRate: 0.5, sampleKey: "{http.request.header.X-User-ID}"}
+	if got := h.sample(tg, requestWithUser("")); !got {
+		t.Errorf("sample() = %v, want fallback to random sampling", got)
+	}
+}
+
+func requestWithUser(user string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	if user != "" {
+		r.Header.Set("X-User-ID", user)
+	}
+	return prepareRequest(r)
+}
+
+// prepareRequest sets up the request context the way a Caddy server would before invoking its handlers
+func prepareRequest(r *http.Request) *http.Request {
+	return caddyhttp.PrepareRequest(r, caddy.NewReplacer(), httptest.NewRecorder(), &caddyhttp.Server{})
+}
+
+func TestHandler_matches(t *testing.T) {
+	h := &Handler{
+		shadowMatch: caddyhttp.MatcherSets{
+			caddyhttp.MatcherSet{caddyhttp.MatchPath{"/api/*"}},
+			caddyhttp.MatcherSet{caddyhttp.MatchMethod{"PUT"}},
+		},
+	}
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{method: "GET", path: "/api/users", want: true},
+		{method: "GET", path: "/static/app.js", want: false},
+		{method: "PUT", path: "/static/app.js", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			r := prepareRequest(httptest.NewRequest(tt.method, tt.path, nil))
+			if got := h.matches(r); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package shadow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	servePrimary            = "primary"
+	serveShadowWithFallback = "shadow_with_fallback"
+	serveRace               = "race"
+
+	placeholderServed = "http.shadow.served"
+)
+
+// provisionServe finds the target whose response may be served, once the targets are provisioned
+func (h *Handler) provisionServe() error {
+	switch h.Serve {
+	case "", servePrimary:
+		if h.ServeTarget != "" || h.ServeSuccess != nil {
+			return fmt.Errorf("serve_target and serve_success require serve %q or %q", serveShadowWithFallback, serveRace)
+		}
+		return nil
+	case serveShadowWithFallback, serveRace:
+	default:
+		return fmt.Errorf("serve must be %q, %q or %q, got %q", servePrimary, serveShadowWithFallback, serveRace, h.Serve)
+	}
+
+	h.served = h.targets[0]
+	if h.ServeTarget != "" {
+		h.served = nil
+		for _, t := range h.targets {
+			if t.name == h.ServeTarget {
+				h.served = t
+			}
+		}
+		if h.served == nil {
+			return fmt.Errorf("serve_target %q is not a shadow target", h.ServeTarget)
+		}
+	}
+
+	h.serveSuccess = caddyhttp.ResponseMatcher{StatusCode: []int{2}}
+	if h.ServeSuccess != nil {
+		h.serveSuccess = *h.ServeSuccess
+	}
+	return nil
+}
+
+// serveSucceeded reports whether a shadowed response can be served in place of the primary's, or, when racing, whether
+// the primary's response can be served. It's only safe to call once the request is done.
+func (h *Handler) serveSucceeded(s *shadowRequest) bool {
+	return s.err == nil && !s.cancelled && h.serveSuccess.Match(s.recorder.Status(), s.recorder.Header())
+}
+
+// writeResponse sends a buffered response downstream. Any headers already in w are replaced with header, usually the
+// headers w had before the primary ran, plus the response's.
+func writeResponse(w http.ResponseWriter, header http.Header, resp response) error {
+	clear(w.Header())
+	maps.Copy(w.Header(), header)
+	maps.Copy(w.Header(), resp.header.Clone())
+	w.WriteHeader(resp.status)
+	_, err := w.Write(resp.body)
+	return err
+}
+
+// startPrimary runs the primary in the background, to race it against the served shadow. Since the primary may keep
+// running after we return, it gets its own vars and replacer, like a shadowed request, and its response is buffered
+// in full, starting from the headers w had before.
+func (h *Handler) startPrimary(r *http.Request, ctx context.Context, requestID string, buf *bytes.Buffer, header http.Header, next caddyhttp.Handler) *shadowRequest {
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, maps.Clone(r.Context().Value(caddyhttp.VarsCtxKey).(map[string]any)))
+	pr := withOwnReplacer(r.Clone(ctx))
+	h.markPrimary(pr, requestID)
+
+	p := &shadowRequest{buf: buf, done: make(chan struct{})}
+	p.recorder = caddyhttp.NewResponseRecorder(&NopResponseWriter{header: header.Clone()}, buf, func(int, http.Header) bool {
+		return true
+	})
+
+	go func() {
+		defer close(p.done)
+		p.err = h.requestProcessor(h.primary, nil)(p.recorder, pr, next)
+		p.cancelled = ctx.Err() != nil
+	}()
+
+	return p
+}
+
+// serveRace serves whichever of the primary and the served shadow is first to finish with a successful response. The
+// loser is cancelled, unless comparing, in which case it's left to finish in the background and compare is called
+// with the primary's response. ctx is the shadows' parent context, which outlives the request.
+func (h *Handler) serveRace(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, ctx context.Context, requestID string, header http.Header, primaryBuf *bytes.Buffer, served *shadowRequest, cancelServed context.CancelFunc, comparing bool, compare func(primary response)) error {
+	primaryCtx, cancelPrimary := context.WithCancel(ctx)
+	primary := h.startPrimary(r, primaryCtx, requestID, primaryBuf, header, next)
+	go func() {
+		<-primary.done
+		cancelPrimary()
+	}()
+
+	if h.race(primary, served) == served {
+		h.recordServed(r, "shadow")
+		if !served.target.shouldCompare() {
+			defer bufferPool.Put(served.buf)
+		}
+		err := writeResponse(w, header, served.response())
+		if !comparing {
+			cancelPrimary()
+			return err
+		}
+
+		// The primary is left to finish in the background, to be compared with the shadows. Nothing bounds it once we
+		// return, so like a shadowed request, it's cut short after the served target's timeout.
+		timeout := time.AfterFunc(served.target.timeout, cancelPrimary)
+		go func() {
+			<-primary.done
+			timeout.Stop()
+			if primary.err != nil || primary.cancelled {
+				return
+			}
+			compare(primary.response())
+		}()
+		return err
+	}
+
+	h.recordServed(r, "primary")
+	if !served.target.shouldCompare() {
+		cancelServed()
+	}
+	if primary.err != nil {
+		return primary.err
+	}
+	err := writeResponse(w, nil, primary.response())
+	compare(primary.response())
+	return err
+}
+
+// race waits for the first of the primary and the served shadow to finish with a successful response. If neither
+// does, the primary wins.
+func (h *Handler) race(primary, shadow *shadowRequest) (winner *shadowRequest) {
+	select {
+	case <-primary.done:
+		if h.serveSucceeded(primary) {
+			return primary
+		}
+		<-shadow.done
+		if h.serveSucceeded(shadow) {
+			return shadow
+		}
+	case <-shadow.done:
+		if h.serveSucceeded(shadow) {
+			return shadow
+		}
+		<-primary.done
+	}
+	return primary
+}
+
+// recordServed records which role's response was sent downstream, as a placeholder and in metrics
+func (h *Handler) recordServed(r *http.Request, role string) {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set(placeholderServed, role)
+	}
+	if h.MetricsName != "" {
+		h.metrics.served.WithLabelValues(role).Inc()
+	}
+}
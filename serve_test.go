@@ -0,0 +1,294 @@
+package shadow
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestHandler_ServeHTTP_serveShadowWithFallback(t *testing.T) {
+	respond := func(name string, status int, err error) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			if err != nil {
+				return err
+			}
+			w.Header().Set("X-"+name, "1")
+			w.WriteHeader(status)
+			_, werr := w.Write([]byte(name))
+			return werr
+		}
+	}
+
+	tests := []struct {
+		name            string
+		primary, shadow handlerFunc
+		body, served    string
+		wantErr         bool
+	}{
+		{
+			name:    "shadow succeeds",
+			primary: respond("primary", http.StatusOK, nil),
+			shadow:  respond("shadow", http.StatusOK, nil),
+			body:    "shadow",
+			served:  "shadow",
+		},
+		{
+			name:    "shadow fails",
+			primary: respond("primary", http.StatusOK, nil),
+			shadow:  respond("shadow", http.StatusBadGateway, nil),
+			body:    "primary",
+			served:  "primary",
+		},
+		{
+			name:    "shadow errors",
+			primary: respond("primary", http.StatusOK, nil),
+			shadow:  respond("shadow", 0, errors.New("shadow is down")),
+			body:    "primary",
+			served:  "primary",
+		},
+		{
+			name:    "primary errors",
+			primary: respond("primary", 0, errors.New("primary is down")),
+			shadow:  respond("shadow", http.StatusOK, nil),
+			body:    "shadow",
+			served:  "shadow",
+		},
+		{
+			name:    "both error",
+			primary: respond("primary", 0, errors.New("primary is down")),
+			shadow:  respond("shadow", 0, errors.New("shadow is down")),
+			served:  "primary",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(tt.primary, tt.shadow)
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareBody: true}
+			h.served = h.targets[0]
+			h.serveSuccess = caddyhttp.ResponseMatcher{StatusCode: []int{2}}
+
+			w := httptest.NewRecorder()
+			w.Header().Set("X-Before", "1")
+			r := prepareRequest(httptest.NewRequest("GET", "/", nil))
+			err := h.ServeHTTP(w, r, nextHandler)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ServeHTTP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			if served := repl.ReplaceAll("{http.shadow.served}", ""); served != tt.served {
+				t.Errorf("{http.shadow.served} = %q, want %q", served, tt.served)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("body = %q, want %q", got, tt.body)
+			}
+			other := "primary"
+			if tt.body == "primary" {
+				other = "shadow"
+			}
+			hdr := w.Result().Header
+			if hdr.Get("X-Before") == "" || hdr.Get("X-"+tt.body) == "" || hdr.Get("X-"+other) != "" {
+				t.Errorf("headers = %v, want X-Before and only the served response's headers", hdr)
+			}
+		})
+	}
+}
+
+func TestHandler_provisionServe(t *testing.T) {
+	targets := []*target{{name: "shadow"}, {name: "rewrite"}}
+	tests := []struct {
+		name    string
+		h       Handler
+		want    string
+		wantErr string
+	}{
+		{name: "primary", h: Handler{}},
+		{name: "first target", h: Handler{Serve: serveShadowWithFallback}, want: "shadow"},
+		{name: "named target", h: Handler{Serve: serveShadowWithFallback, ServeTarget: "rewrite"}, want: "rewrite"},
+		{name: "unknown target", h: Handler{Serve: serveShadowWithFallback, ServeTarget: "other"}, wantErr: "not a shadow target"},
+		{name: "unknown mode", h: Handler{Serve: "shadow"}, wantErr: "serve must be"},
+		{name: "target without mode", h: Handler{ServeTarget: "rewrite"}, wantErr: "require serve"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.targets = targets
+			err := tt.h.provisionServe()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("provisionServe() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("provisionServe() error = %v", err)
+			}
+			var got string
+			if tt.h.served != nil {
+				got = tt.h.served.name
+			}
+			if got != tt.want {
+				t.Errorf("served = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_race(t *testing.T) {
+	// respond answers with the status after the delay, or reports that the request was cancelled first
+	respond := func(name string, status int, delay time.Duration, cancelled chan<- string) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				cancelled <- name
+				return r.Context().Err()
+			}
+			w.WriteHeader(status)
+			_, err := w.Write([]byte(name))
+			return err
+		}
+	}
+
+	tests := []struct {
+		name                      string
+		primaryDelay, shadowDelay time.Duration
+		shadowStatus              int
+		body                      string
+		method                    string
+		cancelled                 string
+	}{
+		{name: "shadow wins", primaryDelay: time.Minute, shadowStatus: http.StatusOK, body: "shadow", cancelled: "primary"},
+		{name: "primary wins", shadowDelay: time.Minute, shadowStatus: http.StatusOK, body: "primary", cancelled: "shadow"},
+		{name: "shadow fails first", primaryDelay: 50 * time.Millisecond, shadowStatus: http.StatusBadGateway, body: "primary"},
+		{name: "request with a body", method: "POST", primaryDelay: 50 * time.Millisecond, shadowStatus: http.StatusOK, body: "primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancelled := make(chan string, 2)
+			h := newTestHandler(
+				respond("primary", http.StatusOK, tt.primaryDelay, cancelled),
+				respond("shadow", tt.shadowStatus, tt.shadowDelay, cancelled),
+			)
+			h.Serve = serveRace
+			allowUnsafeMethods(h, unsafeMethodsAllow)
+			h.served = h.targets[0]
+			h.serveSuccess = caddyhttp.ResponseMatcher{StatusCode: []int{2}}
+
+			var reqBody io.Reader
+			method := "GET"
+			if tt.method != "" {
+				method, reqBody = tt.method, strings.NewReader("body")
+			}
+			w := httptest.NewRecorder()
+			if err := h.ServeHTTP(w, prepareRequest(httptest.NewRequest(method, "/", reqBody)), nextHandler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("body = %q, want %q", got, tt.body)
+			}
+
+			if tt.cancelled == "" {
+				return
+			}
+			select {
+			case got := <-cancelled:
+				if got != tt.cancelled {
+					t.Errorf("%s was cancelled, want %s", got, tt.cancelled)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("the loser, %s, was never cancelled", tt.cancelled)
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_raceCompares(t *testing.T) {
+	tests := []struct {
+		name         string
+		primaryDelay time.Duration
+		timeout      time.Duration
+		wantCompared bool
+	}{
+		{name: "primary finishes", primaryDelay: 20 * time.Millisecond, timeout: time.Second, wantCompared: true},
+		{name: "primary times out", primaryDelay: time.Minute, timeout: 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primaryDone := make(chan error, 1)
+			h := newTestHandler(
+				func(w http.ResponseWriter, r *http.Request) error {
+					select {
+					case <-time.After(tt.primaryDelay):
+					case <-r.Context().Done():
+						primaryDone <- r.Context().Err()
+						return r.Context().Err()
+					}
+					primaryDone <- nil
+					_, err := w.Write([]byte("primary"))
+					return err
+				},
+				func(w http.ResponseWriter, r *http.Request) error {
+					_, err := w.Write([]byte("shadow"))
+					return err
+				},
+			)
+			h.Serve = serveRace
+			h.served = h.targets[0]
+			h.served.timeout = tt.timeout
+			h.serveSuccess = caddyhttp.ResponseMatcher{StatusCode: []int{2}}
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareBody: true}
+			logs := make(logWriter, 10)
+			h.slogger = slog.New(slog.NewTextHandler(logs, nil))
+
+			// Like net/http, the request's context is cancelled as soon as ServeHTTP returns
+			ctx, cancel := context.WithCancel(context.Background())
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, prepareRequest(httptest.NewRequestWithContext(ctx, "GET", "/", nil)), nextHandler)
+			cancel()
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if got := w.Body.String(); got != "shadow" {
+				t.Errorf("body = %q, want the shadow's response", got)
+			}
+
+			// The primary lost, but is still compared once it's done, unless it outlasts the served target's timeout
+			select {
+			case err := <-primaryDone:
+				if cut := err != nil; cut == tt.wantCompared {
+					t.Errorf("primary cut short = %v (%v), want %v", cut, err, !tt.wantCompared)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the primary never finished")
+			}
+			compared := false
+			for wait := time.After(100 * time.Millisecond); !compared; {
+				select {
+				case line := <-logs:
+					compared = strings.Contains(line, "msg=shadow_mismatch")
+				case <-wait:
+					if tt.wantCompared {
+						t.Fatal("the primary was never compared with the shadow")
+					}
+					return
+				}
+			}
+			if !tt.wantCompared {
+				t.Error("a primary cut short should not be compared")
+			}
+		})
+	}
+}
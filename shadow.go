@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"io"
+	"errors"
 	"log/slog"
 	"maps"
 	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -17,9 +19,18 @@ import (
 
 var (
 	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
 )
 
+// errClientGone is the cause of a shadowed request's context being cancelled because the client went away before the
+// primary was done
+var errClientGone = errors.New("client went away")
+
+// errNotNeeded is the cause of a shadowed request's context being cancelled because everything it was needed for is
+// done, like an event stream whose events have been compared
+var errNotNeeded = errors.New("shadowed response no longer needed")
+
 var (
 	bufferPool = sync.Pool{
 		New: func() any {
@@ -36,15 +47,138 @@ type Handler struct {
 	MetricsName string `json:"metrics_name"`
 	metrics     metrics
 
-	ShadowRaw       json.RawMessage `json:"shadow"`
-	PrimaryRaw      json.RawMessage `json:"primary"`
-	shadow, primary caddyhttp.MiddlewareHandler
+	ShadowRaw  json.RawMessage `json:"shadow,omitempty"`
+	PrimaryRaw json.RawMessage `json:"primary"`
+	primary    caddyhttp.MiddlewareHandler
+
+	// SecondaryRaw is an optional second copy of the primary. It's handled like a shadow, and fields which differ
+	// between the primary and secondary responses are learned as noise and left out of comparisons with the shadows.
+	SecondaryRaw json.RawMessage `json:"secondary,omitempty"`
+	secondary    *target
+	noise        *noise
+
+	// RouteKey is a placeholder which identifies the route of a request, for ignore rules and noise. It defaults to
+	// "{http.request.method} {http.request.uri.path}".
+	RouteKey string `json:"route_key,omitempty"`
+
+	// IgnoreFields lists response body fields, by route key, which are left out of comparisons. Fields listed under
+	// "*" are ignored for every route.
+	IgnoreFields map[string][]string `json:"ignore_fields,omitempty"`
+
+	// Learn enables learning ignore rules from the fields which regularly differ between the primary and shadows.
+	Learn     *LearnConfig `json:"learn,omitempty"`
+	learner   *learner
+	learnName string
+
+	// Targets are additional, named shadow handlers. ShadowRaw, if set, is treated as a target named "shadow".
+	Targets []Target `json:"targets,omitempty"`
+	targets []*target
+
+	// Verify holds back the primary's response until every target which compares responses is done, and rejects the
+	// request if any of them differ.
+	Verify *VerifyConfig `json:"verify,omitempty"`
+
+	// DebugHeaders waits for the targets which compare responses, and reports how they compare in the primary's
+	// response headers, or trailers if the primary's response is streamed.
+	DebugHeaders *DebugHeadersConfig `json:"debug_headers,omitempty"`
+
+	// DiffResponse answers requests carrying a secret header with a JSON document comparing the primary's response
+	// with every target's side by side, instead of the primary's response.
+	DiffResponse *DiffResponseConfig `json:"diff_response,omitempty"`
+
+	// Serve decides whose response is sent to the client. "primary", the default, always serves the primary's response.
+	// "shadow_with_fallback" runs the primary and the ServeTarget shadow (defaulting to the first target) to completion,
+	// and serves the shadow's response if it meets ServeSuccess (defaulting to any 2xx status), or the primary's
+	// otherwise. Both responses are buffered in full.
+	Serve        string                     `json:"serve,omitempty"`
+	ServeTarget  string                     `json:"serve_target,omitempty"`
+	ServeSuccess *caddyhttp.ResponseMatcher `json:"serve_success,omitempty"`
+	served       *target
+	serveSuccess caddyhttp.ResponseMatcher
 
+	// ShadowTimeout bounds the time spent handling the shadowed request, defaulting to 30s.
+	ShadowTimeout string `json:"shadow_timeout,omitempty"`
+
+	// PrimaryTimeout optionally bounds the time spent handling the primary request. It's off by default, so that
+	// shadowing never cuts off a slow but legitimate primary request.
+	PrimaryTimeout string `json:"primary_timeout,omitempty"`
+	primaryTimeout time.Duration
+
+	// Timeout is a deprecated alias for ShadowTimeout.
 	Timeout string `json:"timeout,omitempty"`
-	timeout time.Duration
+
+	// ShadowHeader is set on shadowed requests, with ShadowHeaderValue (defaulting to "1"), so that backends can tell
+	// they're handling mirrored traffic.
+	ShadowHeader      string `json:"shadow_header,omitempty"`
+	ShadowHeaderValue string `json:"shadow_header_value,omitempty"`
+
+	// RequestIDHeader is set to the same ID on both the primary and shadowed requests. An ID already present on the
+	// original request is kept.
+	RequestIDHeader string `json:"request_id_header,omitempty"`
+
+	// MaxBodySize is the largest request body which is mirrored to the shadow from memory, defaulting to 10MiB.
+	// LargeBody decides what happens to larger bodies: "skip" (the default) doesn't shadow them, and "spill" mirrors
+	// them through a temp file.
+	MaxBodySize string `json:"max_body_size,omitempty"`
+	maxBodySize int64
+	LargeBody   string `json:"large_body,omitempty"`
+
+	// MaxDecodedSize is the largest response body which is decoded for comparison when it's compressed with gzip,
+	// deflate, br or zstd, defaulting to 10MiB. Responses which decode to more than this aren't compared.
+	MaxDecodedSize string `json:"max_decoded_size,omitempty"`
+	maxDecodedSize int64
+
+	// StreamPrimary sends the primary's response to the client as it's written, even when it's compared, rather than
+	// holding it back until the primary is done. Up to CaptureLimit bytes of it, defaulting to 1MiB, are captured for
+	// comparison. A larger body is compared by hash instead.
+	StreamPrimary bool   `json:"stream_primary,omitempty"`
+	CaptureLimit  string `json:"capture_limit,omitempty"`
+	captureLimit  int64
+
+	// DetachShadow keeps the shadowed request running when the client disconnects before the primary is done. Either
+	// way, the shadowed request keeps running once the primary has answered, bounded by the shadow timeout.
+	DetachShadow bool `json:"detach_shadow,omitempty"`
+
+	// SampleRate is the fraction of requests, between 0 and 1, which are mirrored to the shadow handler. When unset,
+	// every request is mirrored.
+	SampleRate *float64 `json:"sample_rate,omitempty"`
+
+	// SampleKey is an optional placeholder, such as {http.request.header.X-User-ID}, which is hashed to make the
+	// sampling decision. Requests with the same key are consistently either mirrored or not.
+	SampleKey string `json:"sample_key,omitempty"`
+
+	// ShadowMatchRaw limits shadowing to requests matching any of the matcher sets. Requests which don't match are
+	// only handled by the primary.
+	ShadowMatchRaw caddyhttp.RawMatcherSets `json:"shadow_match,omitempty" caddy:"namespace=http.matchers"`
+	shadowMatch    caddyhttp.MatcherSets
+
+	// UnsafeMethods is the policy for mirroring requests with methods other than GET, HEAD and OPTIONS: "block" (the
+	// default) never mirrors them, "allow" mirrors them, and "dry_run" mirrors them with DryRunHeader set (defaulting
+	// to X-Shadow-Dry-Run: 1) so the shadow can run them read-only. "allow" and "dry_run" require UnsafeMatchRaw, and
+	// only mirror the requests it opts in.
+	UnsafeMethods     string                   `json:"unsafe_methods,omitempty"`
+	UnsafeMatchRaw    caddyhttp.RawMatcherSets `json:"unsafe_match,omitempty" caddy:"namespace=http.matchers"`
+	unsafeMatch       caddyhttp.MatcherSets
+	DryRunHeader      string `json:"dry_run_header,omitempty"`
+	DryRunHeaderValue string `json:"dry_run_header_value,omitempty"`
+
+	// MaxInFlight caps the number of shadowed requests being handled at once, for each target. Requests over the
+	// limit aren't mirrored to that target.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// MaxRate caps the rate of shadowed requests to each target with a token bucket, like "200/s". Requests over the
+	// limit aren't mirrored to that target.
+	MaxRate string `json:"max_rate,omitempty"`
+
+	// CircuitBreaker configures a circuit breaker for each target.
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+
+	Backoff *BackoffConfig `json:"backoff,omitempty"`
+	backoff *backoff
 
 	slogger *slog.Logger
 	now     func() time.Time
+	random  func() float64
 }
 
 func (h Handler) CaddyModule() caddy.ModuleInfo {
@@ -55,57 +189,284 @@ func (h Handler) CaddyModule() caddy.ModuleInfo {
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) (err error) {
+	// These also remove the secret headers, so they're checked before the request goes anywhere
+	debug := h.DebugHeaders != nil && h.debugRequested(r)
+	diff := h.DiffResponse != nil && h.diffRequested(r)
+
+	// A diff or debug headers are asked for on purpose, so they're mirrored to every target the request is eligible
+	// for, regardless of sampling
+	targets, tickets := h.shadowTargets(r, diff || debug)
+	if len(targets) > 0 && isWebSocketUpgrade(r) {
+		// WebSocket sessions are mirrored message by message, and the primary's is never held back
+		if h.served != nil {
+			h.recordServed(r, "primary")
+		}
+		return h.mirrorWebSocket(w, r, targets, tickets, next)
+	}
+	diffing := diff && len(targets) > 0
+
+	// The shadow's response can only be served if the request was mirrored to it. Only requests without a body are
+	// raced, since the primary may still be reading the body when the shadow wins.
+	hasBody := r.Body != nil && r.Body != http.NoBody
+	serving := !diffing && h.served != nil && slices.Contains(targets, h.served) && (h.Serve != serveRace || !hasBody)
+	racing := serving && h.Serve == serveRace
+	if h.served != nil && !serving && !diffing {
+		h.recordServed(r, "primary")
+	}
+
+	if len(targets) == 0 {
+		// Requests that aren't shadowed go straight to the primary, without any cloning or buffering
+		return h.requestProcessor(h.primary, nil)(w, r, next)
+	}
+
+	// Everything between here and the downstream write, other than the primary handler itself, is overhead that
+	// shadowing adds to the primary path
+	startedAt := h.now()
+
 	primaryCtx := r.Context()
 
-	// The vars map isn't concurrency safe, so we'll clone it for the shadowed request
-	shadowCtx := context.WithValue(
-		primaryCtx,
-		caddyhttp.VarsCtxKey,
-		maps.Clone(primaryCtx.Value(caddyhttp.VarsCtxKey).(map[string]any)),
-	)
+	// net/http cancels the request's context as soon as we return, so the shadowed requests can't share it, or every
+	// shadow slower than the primary would be cut short. They're bounded by the shadow timeout instead, and unless the
+	// shadow is detached, cancelled if the client goes away while the primary is still being handled.
+	shadowParentCtx := context.WithoutCancel(primaryCtx)
+	if !h.DetachShadow {
+		var cancelShadows context.CancelCauseFunc
+		shadowParentCtx, cancelShadows = context.WithCancelCause(shadowParentCtx)
+		stop := context.AfterFunc(primaryCtx, func() {
+			cancelShadows(errClientGone)
+		})
+		defer stop()
+	}
+
+	// Bodies compared by hash don't need the primary's response to be buffered, only hashed as it streams
+	var comparisons int32
+	var hashes []string
+	compareBuffered := false
+	maxEvents := 0
+	for _, t := range targets {
+		if t.CompareEvents != nil {
+			maxEvents = max(maxEvents, t.CompareEvents.maxEvents)
+		}
+		if !t.shouldCompare() {
+			continue
+		}
+		comparisons++
+		if t.CompareBodyHash == "" {
+			compareBuffered = true
+		} else if !slices.Contains(hashes, t.CompareBodyHash) {
+			hashes = append(hashes, t.CompareBodyHash)
+		}
+	}
 
-	var primaryBuf, shadowBuf *bytes.Buffer
-	if h.shouldCompare() { // Only prepare buffers if we anticipate needing them for response comparison
+	verifying := !diffing && h.Verify != nil && comparisons > 0
+	debugging := !diffing && debug && comparisons > 0 && !serving
+
+	var primaryBuf *bytes.Buffer
+	if comparisons > 0 || serving || diffing { // Only prepare a buffer if we anticipate needing it
+		// This is returned to the pool once the last comparison is done, since comparisons run after we return
 		primaryBuf = bufferPool.Get().(*bytes.Buffer)
-		shadowBuf = bufferPool.Get().(*bytes.Buffer)
-		defer bufferPool.Put(primaryBuf)
-		defer bufferPool.Put(shadowBuf)
 		primaryBuf.Reset()
-		shadowBuf.Reset()
 	}
 
-	pRecorder := caddyhttp.NewResponseRecorder(w, primaryBuf, h.shouldBuffer)
-	sRecorder := caddyhttp.NewResponseRecorder(&NopResponseWriter{}, shadowBuf, h.shouldBuffer)
+	// When the shadow's response may be served instead, or may be rejected, or a diff is sent instead, the primary's
+	// response is held back until we know what to send, along with the headers set before the primary ran
+	var header http.Header
+	if serving || verifying || diffing {
+		header = w.Header().Clone()
+	}
+	primaryWriter := w
+	var primaryDigests *bodyDigests
+	var tee *teeWriter
+	if h.StreamPrimary && compareBuffered && !serving && !verifying && !diffing {
+		// The primary's response is sent as it's written, rather than buffered, and captured for comparison instead
+		tee = newTeeWriter(w, hashes, primaryBuf, h.captureLimit)
+		primaryWriter, primaryDigests = tee, tee.digests
+	} else if len(hashes) > 0 {
+		hw := newHashingWriter(w, hashes)
+		primaryWriter, primaryDigests = hw, hw.digests
+	}
+	var primaryEvents *eventRecorder
+	if maxEvents > 0 && !serving && !verifying && !diffing {
+		// Event streams are compared event by event as they're sent, since they may never end
+		ew := newEventWriter(primaryWriter, maxEvents)
+		primaryWriter, primaryEvents = ew, ew.events
+	}
+	pRecorder := caddyhttp.NewResponseRecorder(primaryWriter, primaryBuf, func(status int, header http.Header) bool {
+		return serving || verifying || diffing ||
+			(tee == nil && compareBuffered && shouldBufferResponse(status, header) && (primaryEvents == nil || !isEventStream(header)))
+	})
 
 	// Clone the request to help ensure that concurrent upstream handlers don't step on each other
+	requestID := h.requestID(r)
 	pr := r.Clone(primaryCtx)
-	sr := r.Clone(shadowCtx)
+	h.markPrimary(pr, requestID)
 
-	if r.Body != nil { // Body is strictly read-once, can't be cloned. So we multiplex it to shadow with io.TeeReader
-		reqBuf := bufferPool.Get().(*bytes.Buffer)
-		reqBuf.Reset()
-		defer bufferPool.Put(reqBuf)
+	// The secondary is only needed to learn noise for comparisons, which diffs leave alone
+	readers := len(targets)
+	useSecondary := h.secondary != nil && comparisons > 0 && !diffing
+	if useSecondary {
+		readers++
+	}
 
-		tee := io.TeeReader(r.Body, reqBuf)
-		pr.Body = io.NopCloser(tee)
-		sr.Body = io.NopCloser(reqBuf)
+	// Body is strictly read-once, can't be cloned. So we multiplex it to the shadows as the primary reads it.
+	var body *bodyMux
+	finishBody := func() {}
+	if hasBody {
+		body = newBodyMux(r.Body, h.maxBodySize, h.LargeBody == largeBodySpill, readers)
+		finishBody = sync.OnceFunc(body.finishPrimary)
+		defer finishBody()
+		pr.Body = body.primary()
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() { // Handle only the shadowed request asynchronously
-		defer wg.Done()
-		sErr := h.requestProcessor("shadow", h.shadow)(sRecorder, sr, next)
-		if sErr != nil { // TODO: Make sure that this error is handled as idiomatically and safely as possible
-			h.slogger.Error("shadow_handler_error", slog.String("error", sErr.Error()))
+	// Each target is handled asynchronously and independently of the others
+	shadows := make([]*shadowRequest, len(targets))
+	var served *shadowRequest
+	cancelServed := func() {}
+	for i, t := range targets {
+		parentCtx := shadowParentCtx
+		if racing && t == h.served {
+			// The served shadow is cancelled if it loses the race, and its response isn't needed for comparisons
+			var cancel context.CancelFunc
+			parentCtx, cancel = context.WithCancel(shadowParentCtx)
+			cancelServed = cancel
 		}
-	}()
+		// A response which may be served, or shown in a diff, has to be buffered in full
+		shadows[i] = h.startShadow(t, tickets[t], r, parentCtx, requestID, diffing || (serving && t == h.served), body, next)
+		if serving && t == h.served {
+			served = shadows[i]
+		}
+	}
+	if racing {
+		go func() {
+			<-served.done
+			cancelServed()
+		}()
+	}
+	var route string
+	if h.ignoring() || h.noise != nil {
+		route = h.routeKey(r)
+	}
+
+	var secondary *shadowRequest
+	if useSecondary {
+		secondary = h.startShadow(h.secondary, 0, r, shadowParentCtx, requestID, false, body, next)
+	}
+	if primaryEvents != nil {
+		for _, s := range shadows {
+			if s.events != nil {
+				go h.compareEventStreams(s, primaryEvents)
+			}
+		}
+	}
 
-	err = h.requestProcessor("primary", h.primary)(pRecorder, pr, next)
+	primaryStartedAt := h.now()
+	if racing {
+		h.observeOverhead(primaryStartedAt.Sub(startedAt))
+		return h.serveRace(w, r, next, shadowParentCtx, requestID, header, primaryBuf, served, cancelServed, comparisons > 0, func(primary response) {
+			h.startComparisons(shadows, secondary, comparisons, primaryBuf, primary, route, body)
+		})
+	}
+
+	err = h.requestProcessor(h.primary, nil)(pRecorder, pr, next)
+	if primaryEvents != nil {
+		primaryEvents.end(primaryCtx.Err() != nil)
+	}
+	if served != nil {
+		// The primary is done with the request body, so the served shadow has all of it it's going to get. Waiting for
+		// the shadow is part of handling the request in this mode, rather than overhead.
+		finishBody()
+		<-served.done
+		if !served.target.shouldCompare() {
+			defer bufferPool.Put(served.buf)
+		}
+	}
+	primaryTime := h.now().Sub(primaryStartedAt)
+
+	if pRecorder.Status() == http.StatusSwitchingProtocols {
+		// The primary has switched protocols and taken over the connection, so there's nothing left to send, to hold
+		// back, or to report
+		if served != nil {
+			h.recordServed(r, "primary")
+		}
+		h.observeOverhead(h.now().Sub(startedAt) - primaryTime)
+		if err != nil {
+			return err
+		}
+		h.startComparisons(shadows, secondary, comparisons, primaryBuf, response{status: pRecorder.Status(), header: pRecorder.Header()}, route, body)
+		return nil
+	}
+
+	if served != nil && h.serveSucceeded(served) {
+		h.recordServed(r, "shadow")
+		primaryErr := err
+		primaryHeader := pRecorder.Header().Clone()
+		err = writeResponse(w, header, served.response())
+		h.observeOverhead(h.now().Sub(startedAt) - primaryTime)
+		if primaryErr != nil {
+			// There's no primary response to compare with
+			bufferPool.Put(primaryBuf)
+			return err
+		}
+		h.startComparisons(shadows, secondary, comparisons, primaryBuf, response{
+			status: pRecorder.Status(),
+			header: primaryHeader,
+			body:   pRecorder.Buffer().Bytes(),
+		}, route, body)
+		return err
+	}
+	if served != nil {
+		h.recordServed(r, "primary")
+	}
+	if diffing {
+		// The primary's error is part of the diff, rather than being returned
+		finishBody()
+		defer bufferPool.Put(primaryBuf)
+		primary := response{status: pRecorder.Status(), header: pRecorder.Header().Clone(), body: primaryBuf.Bytes()}
+		return h.writeDiff(w, header, requestID, route, primary, primaryTime, err, shadows, body)
+	}
 	if err != nil {
 		return err
 	}
 
+	if verifying || debugging {
+		// Waiting for the shadows is part of handling the request in these modes, rather than overhead
+		finishBody()
+		primary := response{status: pRecorder.Status(), header: pRecorder.Header().Clone(), digests: primaryDigests}
+		if pRecorder.Buffered() && shouldBufferResponse(primary.status, primary.header) {
+			// Only responses which would otherwise have been buffered are compared by body
+			primary.body = pRecorder.Buffer().Bytes()
+		}
+		if tee != nil {
+			primary.body, primary.hashOnly = tee.captured()
+		}
+		checks := h.checkTargets(shadows, secondary, primary, route, body)
+		primaryTime = h.now().Sub(primaryStartedAt)
+		defer bufferPool.Put(primaryBuf)
+		defer func() {
+			h.observeOverhead(h.now().Sub(startedAt) - primaryTime)
+		}()
+
+		var report http.Header
+		if debugging {
+			report = debugHeaders(checks)
+		}
+		if failures := verificationFailures(checks); verifying && len(failures) > 0 {
+			maps.Copy(header, report)
+			return h.rejectResponse(w, header, failures)
+		}
+		if !pRecorder.Buffered() {
+			// The primary's response has already been streamed to the client, so it's too late for headers
+			for k, v := range report {
+				w.Header()[http.TrailerPrefix+k] = v
+			}
+			return nil
+		}
+		maps.Copy(w.Header(), report)
+		w.WriteHeader(pRecorder.Status())
+		_, err = w.Write(pRecorder.Buffer().Bytes())
+		return err
+	}
+
 	var pBytes []byte
 	if pRecorder.Buffered() {
 		// We don't want the shadowed request to block sending any response downstream. So here we send the primary response
@@ -118,31 +479,270 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		// allowed to impact handling the shadowed request, getting metrics, doing comparisons, etc.
 		_, err = w.Write(pBytes)
 	}
+	h.observeOverhead(h.now().Sub(startedAt) - primaryTime)
 
-	if h.shouldCompare() {
-		// If we're doing comparison, let's do it async so we can avoid blocking. This way downstream handlers and
-		// clients are able to know we're done with our ResponseWriter here.
+	primary := response{status: pRecorder.Status(), header: pRecorder.Header(), body: pBytes, digests: primaryDigests}
+	if tee != nil {
+		primary.body, primary.hashOnly = tee.captured()
+	}
+	h.startComparisons(shadows, secondary, comparisons, primaryBuf, primary, route, body)
+	return err
+}
+
+// startComparisons compares each target's response with the primary's in the background, as each shadowed request is
+// done. The primary's buffer is returned to the pool once the last comparison is done.
+func (h *Handler) startComparisons(shadows []*shadowRequest, secondary *shadowRequest, comparisons int32, primaryBuf *bytes.Buffer, primary response, route string, body *bodyMux) {
+	if comparisons == 0 {
+		if primaryBuf != nil {
+			bufferPool.Put(primaryBuf)
+		}
+		return
+	}
+
+	// If we're doing comparison, let's do it async so we can avoid blocking. This way downstream handlers and
+	// clients are able to know we're done with our ResponseWriter here. Each target is compared as soon as it's
+	// done, so a slow target doesn't hold up comparing the others. The primary's body is decoded by whichever
+	// comparison needs it first.
+	decodedPrimary := h.newPrimaryResponse(primary)
+	pending := new(atomic.Int32)
+	pending.Store(comparisons)
+	for _, s := range shadows {
+		if !s.target.shouldCompare() {
+			continue
+		}
 		go func() {
-			wg.Wait()
-			var sBytes []byte
-			if sRecorder.Buffered() {
-				sBytes = sRecorder.Buffer().Bytes()
-			}
-			h.compareBody(pBytes, sBytes)
-			h.compareHeaders(pRecorder.Header(), sRecorder.Header())
-			h.compareStatus(pRecorder.Status(), sRecorder.Status())
+			<-s.done
+			defer func() {
+				if pending.Add(-1) == 0 {
+					bufferPool.Put(primaryBuf)
+					if secondary != nil {
+						// The secondary may still be running if every comparison was skipped
+						<-secondary.done
+						bufferPool.Put(secondary.buf)
+					}
+				}
+			}()
+			defer bufferPool.Put(s.buf)
+			h.compare(s, secondary, decodedPrimary, route, body)
 		}()
 	}
+}
 
-	return err
+// shadowRequest is a request mirrored to a single target. When racing, the primary is run as a shadowRequest without a
+// target.
+type shadowRequest struct {
+	target   *target
+	ticket   breakerTicket
+	recorder caddyhttp.ResponseRecorder
+	buf      *bytes.Buffer
+	done     chan struct{}
+
+	// digests hashes the response body as it's written, when the target compares bodies by hash
+	digests *bodyDigests
+
+	// events records the response as it's written, when the target compares event streams, and stop ends the shadowed
+	// request once its events have been compared
+	events *eventRecorder
+	stop   context.CancelCauseFunc
+
+	// err is the error returned by the target's handler, and latency is how long it took. They're only safe to read
+	// once done is closed.
+	err     error
+	latency time.Duration
+
+	// cancelled records whether the shadowed request was cut short because the client went away. It's only safe to
+	// read once done is closed.
+	cancelled bool
+
+	// counted holds the fields already counted as noise, when this is the secondary, so that a request compared by
+	// several targets only counts each difference once
+	countedMu sync.Mutex
+	counted   map[string]bool
 }
 
-func (h *Handler) requestProcessor(name string, inner caddyhttp.MiddlewareHandler) func(wr http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	return func(wr http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+// uncounted returns the fields which haven't been counted as noise for this request yet, and marks them as counted
+func (s *shadowRequest) uncounted(fields []string) (uncounted []string) {
+	s.countedMu.Lock()
+	defer s.countedMu.Unlock()
+	for _, field := range fields {
+		if !s.counted[field] {
+			if s.counted == nil {
+				s.counted = make(map[string]bool)
+			}
+			s.counted[field] = true
+			uncounted = append(uncounted, field)
+		}
+	}
+	return uncounted
+}
+
+// startShadow mirrors the request to a target in the background. The target's slot in the shadow budget is released
+// once the shadowed request is done, and its outcome is recorded in the target's breaker with ticket. With buffer set,
+// the whole response is buffered, whether or not it's compared.
+func (h *Handler) startShadow(t *target, ticket breakerTicket, r *http.Request, parentCtx context.Context, requestID string, buffer bool, body *bodyMux, next caddyhttp.Handler) *shadowRequest {
+	s := &shadowRequest{target: t, ticket: ticket, done: make(chan struct{})}
+	if t.shouldCompare() || buffer {
+		// This is returned to the pool once the comparison is done, since the shadow may still be writing to its
+		// buffer long after we return
+		s.buf = bufferPool.Get().(*bytes.Buffer)
+		s.buf.Reset()
+	}
+	var shadowWriter http.ResponseWriter = &NopResponseWriter{}
+	if t.CompareBodyHash != "" {
+		hw := newHashingWriter(shadowWriter, []string{t.CompareBodyHash})
+		shadowWriter, s.digests = hw, hw.digests
+	}
+	if t.CompareEvents != nil {
+		ew := newEventWriter(shadowWriter, t.CompareEvents.maxEvents)
+		shadowWriter, s.events = ew, ew.events
+	}
+	s.recorder = caddyhttp.NewResponseRecorder(shadowWriter, s.buf, func(status int, header http.Header) bool {
+		return buffer || t.shouldBuffer(status, header)
+	})
+
+	h.runShadow(s, r, parentCtx, requestID, body, next)
+	return s
+}
+
+// runShadow handles a shadowed request with the target's handler in the background, writing to s.recorder, and closes
+// s.done once it's done
+func (h *Handler) runShadow(s *shadowRequest, r *http.Request, parentCtx context.Context, requestID string, body *bodyMux, next caddyhttp.Handler) {
+	// The vars map isn't concurrency safe, so we'll clone it for each shadowed request
+	ctx := context.WithValue(
+		parentCtx,
+		caddyhttp.VarsCtxKey,
+		maps.Clone(r.Context().Value(caddyhttp.VarsCtxKey).(map[string]any)),
+	)
+	t := s.target
+	sr := h.markShadow(r.Clone(ctx), t, requestID)
+	if body != nil {
+		sr.Body = body.shadow()
+	}
+	if t.CompareEvents != nil {
+		// Event streams may never end, so they're stopped once compared, rather than left to run until the timeout
+		var stopCtx context.Context
+		stopCtx, s.stop = context.WithCancelCause(sr.Context())
+		sr = sr.WithContext(stopCtx)
+	}
+
+	go func() {
+		defer close(s.done)
+		defer t.release()
+		if s.stop != nil {
+			defer s.stop(nil)
+		}
+
 		// Even though there may be a timeout provided by another handler, we really want to make sure we keep our
-		// goroutines tidy. We're enforcing a timeout on all request processing as mitigation for the possibility of
-		// goroutine leaks and connection leaks.
-		ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+		// goroutines tidy. We're enforcing a timeout on shadow request processing as mitigation for the possibility of
+		// goroutine leaks and connection leaks. WebSocket sessions last as long as the client keeps them open, and a
+		// mirrored one ends with the primary's, so they don't get one.
+		handlerCtx, cancel := context.WithCancel(sr.Context())
+		if !isWebSocketUpgrade(sr) {
+			handlerCtx, cancel = context.WithTimeout(sr.Context(), t.timeout)
+		}
+		defer cancel()
+
+		startedAt := h.now()
+		s.err = h.requestProcessor(t.handler, t)(s.recorder, sr.WithContext(handlerCtx), next)
+		s.latency = h.now().Sub(startedAt)
+		s.cancelled = ctx.Err() != nil
+		if !s.cancelled && context.Cause(handlerCtx) == errNotNeeded {
+			// Stopping the shadowed request is how it completes, so whatever it returned says nothing about it
+			s.err = nil
+		}
+		if t.breaker != nil {
+			if s.cancelled || (s.err != nil && body.incomplete() != "") {
+				// A client disconnect, or a request body the shadow couldn't be sent in full, says nothing about the
+				// health of the shadow
+				t.breaker.abandon(s.ticket)
+			} else {
+				t.breaker.record(s.ticket, s.err != nil, handlerCtx.Err() == context.DeadlineExceeded)
+			}
+		}
+		if body != nil {
+			_ = sr.Body.Close()
+		}
+	}()
+}
+
+// compare compares a target's response with the primary's, once the shadowed request is done, and reports the result.
+// With a secondary, the noise between the primary and the secondary is learned first. Compressed bodies are decoded
+// before they're compared.
+func (h *Handler) compare(s, secondary *shadowRequest, decodedPrimary *primaryResponse, route string, body *bodyMux) comparison {
+	t := s.target
+	if s.cancelled {
+		// A response cut short by the client going away would only ever report a bogus mismatch
+		h.slogger.Debug("shadow_comparison_skipped", slog.String("target", t.name), slog.String("reason", "cancelled"))
+		return comparison{skipped: "cancelled"}
+	}
+	if reason := body.incomplete(); reason != "" {
+		// The shadow never saw the whole request body, so its response can't be compared
+		h.slogger.Debug("shadow_comparison_skipped", slog.String("target", t.name), slog.String("reason", reason))
+		return comparison{skipped: reason}
+	}
+	if s.err != nil {
+		// The target's error has already been logged and counted
+		return comparison{err: s.err}
+	}
+	primary, shadow, err := h.decodeResponses(s, decodedPrimary)
+	if err != nil {
+		h.slogger.Debug("shadow_comparison_skipped",
+			slog.String("target", t.name),
+			slog.String("reason", skipReason(err)),
+			slog.String("error", err.Error()),
+		)
+		return comparison{skipped: skipReason(err)}
+	}
+
+	if secondary != nil {
+		h.learnNoise(t, secondary, primary, route)
+	}
+
+	c := h.compareResponses(t, route, primary, shadow)
+	h.report(t, route, c)
+	return c
+}
+
+// learnNoise counts the fields which differ between the primary's response and the secondary's, once the secondary is
+// done. A secondary which failed, or answered with a different class of status, is having trouble of its own rather
+// than showing nondeterminism, so nothing is learned from it.
+func (h *Handler) learnNoise(t *target, secondary *shadowRequest, primary response, route string) {
+	<-secondary.done
+	if secondary.cancelled || secondary.err != nil || secondary.recorder.Status()/100 != primary.status/100 {
+		return
+	}
+	secondaryResp, err := h.decodeFor(t, primary, secondary.response())
+	if err != nil {
+		return
+	}
+	for _, field := range h.noise.learn(route, secondary.uncounted(t.fieldDiffs(primary, secondaryResp))) {
+		h.slogger.Info("shadow_noise_learned", slog.String("route", route), slog.String("field", field))
+	}
+}
+
+// response returns the shadowed response. It's only safe to call once done is closed.
+func (s *shadowRequest) response() response {
+	var body []byte
+	if s.recorder.Buffered() {
+		body = s.recorder.Buffer().Bytes()
+	}
+	return response{status: s.recorder.Status(), header: s.recorder.Header(), body: body, digests: s.digests}
+}
+
+// requestProcessor wraps the primary handler, when t is nil, or the handler of a shadow target
+func (h *Handler) requestProcessor(inner caddyhttp.MiddlewareHandler, t *target) func(wr http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// Shadowed requests are bounded by the shadow timeout in runShadow, and the primary only gets a timeout if one is
+	// explicitly configured
+	name, timeout, m, attrs := "primary", h.primaryTimeout, h.metrics.primary, []any(nil)
+	if t != nil {
+		name, timeout, m, attrs = "shadow", 0, t.metrics.roleMetrics, []any{slog.String("target", t.name)}
+	}
+
+	return func(wr http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+		ctx, cancel := context.WithCancel(r.Context())
+		if timeout > 0 && !isWebSocketUpgrade(r) {
+			ctx, cancel = context.WithTimeout(r.Context(), timeout)
+		}
 		defer cancel()
 		r = r.WithContext(ctx)
 		startedAt := h.now()
@@ -162,15 +762,31 @@ func (h *Handler) requestProcessor(name string, inner caddyhttp.MiddlewareHandle
 			// TimedWriter lets us capture the time when we first start receiving a response body, and the time when we
 			// first receive a response status, allowing us to track time to first byte.
 			wr = NewTimedWriter(wr, func() {
-				h.metrics.ttfb[name].Observe(time.Since(startedAt).Seconds())
+				m.ttfb.Observe(time.Since(startedAt).Seconds())
 			})
 		}
 		err := inner.ServeHTTP(wr, r, next)
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		// Our own cancel func hasn't run yet, and shadowed requests aren't cancelled when the primary's handler returns,
+		// so a cancelled context means the request was cut short on purpose, usually because the client went away. A
+		// shadowed request stopped because it's no longer needed has completed, rather than being cancelled.
+		cancelled := ctx.Err() == context.Canceled
+		stopped := cancelled && context.Cause(ctx) == errNotNeeded
 		if h.MetricsName != "" {
-			h.metrics.totalTime[name].Observe(time.Since(startedAt).Seconds())
+			m.totalTime.Observe(time.Since(startedAt).Seconds())
+			if timedOut {
+				m.timeouts.Inc()
+			}
+			if cancelled && !stopped {
+				m.cancellations.Inc()
+			}
 		}
 		if err != nil {
-			h.slogger.Error(name+"_handler_error", slog.String("error", err.Error()))
+			if cancelled {
+				h.slogger.Debug(name+"_handler_cancelled", append(attrs, slog.String("error", err.Error()))...)
+			} else {
+				h.slogger.Error(name+"_handler_error", append(attrs, slog.String("error", err.Error()))...)
+			}
 		}
 		return err
 	}
@@ -0,0 +1,502 @@
+package shadow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// handlerFunc adapts a function into an inner primary or shadow handler
+type handlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+func (f handlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	return f(w, r)
+}
+
+// newTestHandler builds a Handler the way Provision would, without needing a caddy.Context
+func newTestHandler(primary, shadow handlerFunc) *Handler {
+	return &Handler{
+		primary: primary,
+		targets: []*target{{
+			name:       "shadow",
+			handler:    shadow,
+			sampleRate: 1,
+			timeout:    30 * time.Second,
+		}},
+		maxBodySize:    10 << 20,
+		maxDecodedSize: 10 << 20,
+		slogger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		now:            time.Now,
+		random:         func() float64 { return 0 },
+	}
+}
+
+var nextHandler = caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+func TestHandler_ServeHTTP_timeouts(t *testing.T) {
+	shadowDone := make(chan error, 1)
+	h := newTestHandler(
+		func(w http.ResponseWriter, r *http.Request) error {
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+				t.Errorf("primary request was cancelled: %v", r.Context().Err())
+			}
+			_, err := w.Write([]byte("primary"))
+			return err
+		},
+		func(w http.ResponseWriter, r *http.Request) error {
+			<-r.Context().Done()
+			shadowDone <- r.Context().Err()
+			return nil
+		},
+	)
+	h.targets[0].timeout = 10 * time.Millisecond
+
+	w := httptest.NewRecorder()
+	if err := h.ServeHTTP(w, prepareRequest(httptest.NewRequest("GET", "/", nil)), nextHandler); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+	if w.Body.String() != "primary" {
+		t.Errorf("response body = %q, want primary", w.Body.String())
+	}
+
+	select {
+	case err := <-shadowDone:
+		if err == nil {
+			t.Errorf("shadow request should have timed out")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("shadow request was never cut off by shadow_timeout")
+	}
+}
+
+func TestHandler_ServeHTTP_primaryTimeout(t *testing.T) {
+	h := newTestHandler(
+		func(w http.ResponseWriter, r *http.Request) error {
+			<-r.Context().Done()
+			return r.Context().Err()
+		},
+		func(w http.ResponseWriter, r *http.Request) error { return nil },
+	)
+	h.primaryTimeout = 10 * time.Millisecond
+
+	err := h.ServeHTTP(httptest.NewRecorder(), prepareRequest(httptest.NewRequest("GET", "/", nil)), nextHandler)
+	if err == nil {
+		t.Errorf("ServeHTTP() should fail once primary_timeout passes")
+	}
+}
+
+func TestHandler_ServeHTTP_detachShadow(t *testing.T) {
+	for _, detach := range []bool{false, true} {
+		t.Run(fmt.Sprintf("detach %v", detach), func(t *testing.T) {
+			ctx, disconnect := context.WithCancel(context.Background())
+			shadowDone := make(chan error, 1)
+			h := newTestHandler(
+				func(w http.ResponseWriter, r *http.Request) error {
+					disconnect()
+					w.WriteHeader(http.StatusNoContent)
+					return nil
+				},
+				func(w http.ResponseWriter, r *http.Request) error {
+					select {
+					case <-time.After(20 * time.Millisecond):
+						shadowDone <- nil
+					case <-r.Context().Done():
+						shadowDone <- r.Context().Err()
+					}
+					return nil
+				},
+			)
+			h.DetachShadow = detach
+
+			r := prepareRequest(httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+			_ = h.ServeHTTP(httptest.NewRecorder(), r, nextHandler)
+
+			err := <-shadowDone
+			if detach && err != nil {
+				t.Errorf("detached shadow request was cancelled: %v", err)
+			}
+			if !detach && err == nil {
+				t.Errorf("shadow request should be cancelled along with the client")
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_server(t *testing.T) {
+	tests := []struct {
+		name       string
+		disconnect bool
+	}{
+		// net/http cancels the request's context once the handler returns, which mustn't cut off a slower shadow
+		{name: "slow shadow"},
+		{name: "client disconnects", disconnect: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primaryStarted := make(chan struct{})
+			shadowDone := make(chan error, 1)
+			h := newTestHandler(
+				func(w http.ResponseWriter, r *http.Request) error {
+					close(primaryStarted)
+					if tt.disconnect {
+						<-r.Context().Done()
+						return r.Context().Err()
+					}
+					w.WriteHeader(http.StatusOK)
+					return nil
+				},
+				func(w http.ResponseWriter, r *http.Request) error {
+					select {
+					case <-time.After(50 * time.Millisecond):
+					case <-r.Context().Done():
+					}
+					shadowDone <- context.Cause(r.Context())
+					w.WriteHeader(http.StatusInternalServerError)
+					return nil
+				},
+			)
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareStatus: true}
+			logs := make(logWriter, 10)
+			h.slogger = slog.New(slog.NewTextHandler(logs, nil))
+			withMetrics(t, h)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = h.ServeHTTP(w, prepareRequest(r), nextHandler)
+			}))
+			defer srv.Close()
+
+			ctx, disconnect := context.WithCancel(context.Background())
+			defer disconnect()
+			go func() {
+				<-primaryStarted
+				if tt.disconnect {
+					disconnect()
+				}
+			}()
+			req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+			if resp, err := srv.Client().Do(req); err == nil {
+				_ = resp.Body.Close()
+			} else if !tt.disconnect {
+				t.Fatalf("Do() error = %v", err)
+			}
+
+			cause := <-shadowDone
+			if tt.disconnect {
+				if !errors.Is(cause, errClientGone) {
+					t.Errorf("shadow context cause = %v, want %v", cause, errClientGone)
+				}
+				return
+			}
+			if cause != nil {
+				t.Fatalf("shadow request was cut short once the primary answered: %v", cause)
+			}
+			timeout := time.After(time.Second)
+			for {
+				select {
+				case line := <-logs:
+					if strings.Contains(line, "shadow_status_mismatch") {
+						if n := testutil.ToFloat64(h.targets[0].metrics.cancellations); n != 0 {
+							t.Errorf("shadow cancellations = %v, want 0", n)
+						}
+						return
+					}
+				case <-timeout:
+					t.Fatal("the slow shadow was never compared")
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_requestBody(t *testing.T) {
+	body := strings.Repeat("caddy-shadow ", 10000)
+	shadowBody := make(chan string, 1)
+	h := newTestHandler(
+		func(w http.ResponseWriter, r *http.Request) error {
+			// Give the shadow a head start, so that it's waiting on the primary
+			time.Sleep(10 * time.Millisecond)
+			b, err := io.ReadAll(r.Body)
+			if err != nil || string(b) != body {
+				t.Errorf("primary read %d bytes, error = %v", len(b), err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		},
+		func(w http.ResponseWriter, r *http.Request) error {
+			b, _ := io.ReadAll(r.Body)
+			shadowBody <- string(b)
+			return nil
+		},
+	)
+
+	allowUnsafeMethods(h, unsafeMethodsAllow)
+
+	r := prepareRequest(httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if err := h.ServeHTTP(httptest.NewRecorder(), r, nextHandler); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if got := <-shadowBody; got != body {
+		t.Errorf("shadow read %d bytes, want %d", len(got), len(body))
+	}
+}
+
+func TestHandler_ServeHTTP_unreadBody(t *testing.T) {
+	shadowErr := make(chan error, 1)
+	h := newTestHandler(
+		func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return nil
+		},
+		func(w http.ResponseWriter, r *http.Request) error {
+			_, err := io.ReadAll(r.Body)
+			shadowErr <- err
+			return err
+		},
+	)
+	allowUnsafeMethods(h, unsafeMethodsAllow)
+
+	// The primary rejects the upload without reading it, and mustn't be held up until the rest of it arrives
+	body, upload := io.Pipe()
+	defer upload.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- h.ServeHTTP(httptest.NewRecorder(), prepareRequest(httptest.NewRequest("POST", "/", body)), nextHandler)
+	}()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeHTTP() waited for the body the primary never read")
+	}
+
+	// Nothing reads the body once the primary is done, since the server owns it, so the shadow is cut off
+	if err := <-shadowErr; !errors.Is(err, errBodyUnread) {
+		t.Errorf("shadow read error = %v, want %v", err, errBodyUnread)
+	}
+	wrote := make(chan struct{})
+	go func() {
+		_, _ = upload.Write([]byte("late body"))
+		close(wrote)
+	}()
+	select {
+	case <-wrote:
+		t.Error("the rest of the body was read after ServeHTTP() returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHandler_ServeHTTP_dryRun(t *testing.T) {
+	shadowHeader := make(chan string, 1)
+	h := newTestHandler(
+		func(w http.ResponseWriter, r *http.Request) error {
+			if r.Header.Get("X-Shadow-Dry-Run") != "" {
+				t.Errorf("primary request should not be marked as a dry run")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		},
+		func(w http.ResponseWriter, r *http.Request) error {
+			shadowHeader <- r.Header.Get("X-Shadow-Dry-Run")
+			return nil
+		},
+	)
+	allowUnsafeMethods(h, unsafeMethodsDryRun)
+
+	r := prepareRequest(httptest.NewRequest("DELETE", "/orders/1", nil))
+	if err := h.ServeHTTP(httptest.NewRecorder(), r, nextHandler); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+	if got := <-shadowHeader; got != "1" {
+		t.Errorf("shadow X-Shadow-Dry-Run = %q, want 1", got)
+	}
+}
+
+func TestHandler_ServeHTTP_markRequests(t *testing.T) {
+	type seen struct {
+		role, requestID, shadowHeader, requestIDHeader string
+	}
+	observe := func(into chan<- seen) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			repl.Set("side_effect", "set")
+			into <- seen{
+				role:            repl.ReplaceAll("{http.shadow.role}", ""),
+				requestID:       repl.ReplaceAll("{http.shadow.request_id}", ""),
+				shadowHeader:    r.Header.Get("X-Shadow-Request"),
+				requestIDHeader: r.Header.Get("X-Request-ID"),
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+	primarySeen, shadowSeen := make(chan seen, 1), make(chan seen, 1)
+	h := newTestHandler(observe(primarySeen), observe(shadowSeen))
+	h.ShadowHeader = "X-Shadow-Request"
+	h.RequestIDHeader = "X-Request-ID"
+
+	r := prepareRequest(httptest.NewRequest("GET", "/", nil))
+	r.Header.Set("X-Request-ID", "abc123")
+	if err := h.ServeHTTP(httptest.NewRecorder(), r, nextHandler); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if got, want := <-primarySeen, (seen{"primary", "abc123", "", "abc123"}); got != want {
+		t.Errorf("primary saw %+v, want %+v", got, want)
+	}
+	if got, want := <-shadowSeen, (seen{"shadow", "abc123", "1", "abc123"}); got != want {
+		t.Errorf("shadow saw %+v, want %+v", got, want)
+	}
+}
+
+// logWriter sends each log record to a channel
+type logWriter chan string
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestHandler_ServeHTTP_targets(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	seen := make(chan string, 2)
+	shadow := func(status int, wait bool) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			seen <- repl.ReplaceAll("{http.shadow.target}", "")
+			if wait {
+				<-release
+			}
+			w.WriteHeader(status)
+			return nil
+		}
+	}
+
+	h := newTestHandler(
+		func(w http.ResponseWriter, r *http.Request) error {
+			_, err := w.Write([]byte("primary"))
+			return err
+		},
+		nil,
+	)
+	h.targets = []*target{
+		{name: "slow", handler: shadow(http.StatusOK, true), sampleRate: 1, timeout: 30 * time.Second,
+			ComparisonConfig: ComparisonConfig{CompareStatus: true}},
+		{name: "fast", handler: shadow(http.StatusInternalServerError, false), sampleRate: 1, timeout: 30 * time.Second,
+			ComparisonConfig: ComparisonConfig{CompareStatus: true}},
+	}
+	logs := make(logWriter, 10)
+	h.slogger = slog.New(slog.NewTextHandler(logs, nil))
+
+	if err := h.ServeHTTP(httptest.NewRecorder(), prepareRequest(httptest.NewRequest("GET", "/", nil)), nextHandler); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	targets := map[string]bool{<-seen: true, <-seen: true}
+	if !targets["slow"] || !targets["fast"] {
+		t.Errorf("targets saw {http.shadow.target} = %v, want slow and fast", targets)
+	}
+
+	// The fast target is compared while the slow one is still running
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case line := <-logs:
+			if strings.Contains(line, "target=slow") {
+				t.Fatalf("slow target was compared before it was done: %s", line)
+			}
+			if strings.Contains(line, "shadow_status_mismatch") && strings.Contains(line, "target=fast") {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("fast target was never compared")
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_secondary(t *testing.T) {
+	respond := func(status int, body string) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(status)
+			_, err := w.Write([]byte(body))
+			return err
+		}
+	}
+	tests := []struct {
+		name      string
+		secondary handlerFunc
+		want      string
+	}{
+		{name: "noise", secondary: respond(http.StatusOK, `{"id":"b2","name":"caddy"}`), want: "regressions=[body/name] noise=[body/id]"},
+		{name: "secondary fails", secondary: respond(http.StatusBadGateway, `{"error":"bad gateway"}`), want: "regressions=\"[body/id body/name]\" noise=[]"},
+		{
+			name:      "secondary errors",
+			secondary: func(w http.ResponseWriter, r *http.Request) error { return errors.New("secondary is down") },
+			want:      "regressions=\"[body/id body/name]\" noise=[]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roles := make(chan string, minNoiseDifferences)
+			h := newTestHandler(
+				respond(http.StatusOK, `{"id":"a1","name":"caddy"}`),
+				respond(http.StatusOK, `{"id":"c3","name":"shadow"}`),
+			)
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareBody: true}
+			h.secondary = &target{
+				name: "secondary",
+				handler: handlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+					roles <- repl.ReplaceAll("{http.shadow.role}", "")
+					return tt.secondary(w, r)
+				}),
+				timeout:          30 * time.Second,
+				ComparisonConfig: ComparisonConfig{CompareBody: true},
+			}
+			h.noise = newNoise()
+			logs := make(logWriter, 10)
+			h.slogger = slog.New(slog.NewTextHandler(logs, nil))
+
+			// A field is only noise once it's differed between the primary and the secondary a few times
+			var mismatch string
+			for range minNoiseDifferences {
+				if err := h.ServeHTTP(httptest.NewRecorder(), prepareRequest(httptest.NewRequest("GET", "/", nil)), nextHandler); err != nil {
+					t.Fatalf("ServeHTTP() error = %v", err)
+				}
+				if role := <-roles; role != "secondary" {
+					t.Errorf("secondary {http.shadow.role} = %q, want secondary", role)
+				}
+				mismatch = ""
+				for timeout := time.After(time.Second); mismatch == ""; {
+					select {
+					case line := <-logs:
+						if strings.Contains(line, "msg=shadow_mismatch") {
+							mismatch = line
+						}
+					case <-timeout:
+						t.Fatalf("shadow was never compared")
+					}
+				}
+			}
+			if !strings.Contains(mismatch, tt.want) {
+				t.Errorf("mismatch = %s, want %s", mismatch, tt.want)
+			}
+		})
+	}
+}
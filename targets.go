@@ -0,0 +1,203 @@
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"golang.org/x/time/rate"
+)
+
+const placeholderTarget = "http.shadow.target"
+
+// Target is a named shadow handler. Each target is sampled, timed and compared against the primary independently of
+// the others. Settings left unset are inherited from the Handler, and a target without any comparisons of its own uses
+// the Handler's comparisons.
+type Target struct {
+	Name      string          `json:"name"`
+	ShadowRaw json.RawMessage `json:"shadow"`
+
+	ComparisonConfig
+
+	SampleRate    *float64 `json:"sample_rate,omitempty"`
+	SampleKey     string   `json:"sample_key,omitempty"`
+	ShadowTimeout string   `json:"shadow_timeout,omitempty"`
+}
+
+// target is a provisioned Target. Each target has its own shadow budget and circuit breaker, so that a slow or failing
+// target can't starve the others.
+type target struct {
+	name    string
+	handler caddyhttp.MiddlewareHandler
+	ComparisonConfig
+
+	sampleRate float64
+	sampleKey  string
+	timeout    time.Duration
+
+	maxInFlight int
+	inFlight    atomic.Int64
+	limiter     *rate.Limiter
+	breaker     *breaker
+
+	metrics targetMetrics
+}
+
+// provisionTargets provisions the unnamed shadow handler, if any, as a target named "shadow", followed by the named
+// targets.
+func (h *Handler) provisionTargets(ctx caddy.Context) error {
+	targets := h.Targets
+	if h.ShadowRaw != nil {
+		targets = append([]Target{{Name: "shadow", ShadowRaw: h.ShadowRaw}}, targets...)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("at least one shadow handler is required")
+	}
+
+	// The secondary shares the target metrics, so its name is reserved
+	seen := make(map[string]bool, len(targets))
+	seen["secondary"] = h.SecondaryRaw != nil
+	h.targets = make([]*target, len(targets))
+	for i := range targets {
+		cfg := &targets[i]
+		if cfg.Name == "" {
+			return fmt.Errorf("shadow target %d requires a name", i)
+		}
+		if seen[cfg.Name] {
+			return fmt.Errorf("duplicate shadow target %q", cfg.Name)
+		}
+		seen[cfg.Name] = true
+
+		t, err := h.provisionTarget(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("error provisioning shadow target %q: %w", cfg.Name, err)
+		}
+		h.targets[i] = t
+	}
+
+	if h.SecondaryRaw != nil {
+		// The secondary is handled like a target that's never sampled, limited or compared on its own. Its response
+		// is always buffered, since it's only used to learn noise.
+		var err error
+		h.secondary, err = h.provisionTarget(ctx, &Target{
+			Name:             "secondary",
+			ShadowRaw:        h.SecondaryRaw,
+			ComparisonConfig: ComparisonConfig{CompareBody: true},
+		})
+		if err != nil {
+			return fmt.Errorf("error provisioning secondary: %w", err)
+		}
+		h.secondary.maxInFlight, h.secondary.limiter, h.secondary.breaker = 0, nil, nil
+		h.noise = newNoise()
+	}
+
+	return nil
+}
+
+func (h *Handler) provisionTarget(ctx caddy.Context, cfg *Target) (t *target, err error) {
+	t = &target{
+		name:        cfg.Name,
+		maxInFlight: h.MaxInFlight,
+	}
+
+	t.handler, err = loadSubroute(ctx, cfg.ShadowRaw)
+	if err != nil {
+		return nil, fmt.Errorf("error loading shadow module: %w", err)
+	}
+
+	err = cfg.ComparisonConfig.provision()
+	if err != nil {
+		return nil, err
+	}
+	t.ComparisonConfig = cfg.ComparisonConfig
+	if !t.hasComparisons() {
+		t.ComparisonConfig = h.ComparisonConfig
+	}
+
+	sampleRate := cfg.SampleRate
+	if sampleRate == nil {
+		sampleRate = h.SampleRate
+	}
+	t.sampleRate = 1
+	if sampleRate != nil {
+		if *sampleRate < 0 || *sampleRate > 1 {
+			return nil, fmt.Errorf("sample_rate must be between 0 and 1, got %v", *sampleRate)
+		}
+		t.sampleRate = *sampleRate
+	}
+
+	t.sampleKey = cfg.SampleKey
+	if t.sampleKey == "" {
+		t.sampleKey = h.SampleKey
+	}
+
+	timeout := cfg.ShadowTimeout
+	if timeout == "" {
+		timeout = h.ShadowTimeout
+	}
+	if timeout == "" {
+		timeout = h.Timeout
+	}
+	t.timeout = 30 * time.Second
+	if timeout != "" {
+		t.timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing shadow_timeout: %w", err)
+		}
+		if t.timeout <= 0 {
+			return nil, fmt.Errorf("shadow_timeout must be positive, got %s", timeout)
+		}
+	}
+
+	if h.MaxRate != "" {
+		t.limiter, err = parseRate(h.MaxRate)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing max_rate: %w", err)
+		}
+	}
+
+	if h.MetricsName != "" {
+		t.metrics = h.metrics.forTarget(t.name)
+		t.metrics.effectiveRate.Set(t.sampleRate)
+	}
+
+	if h.CircuitBreaker != nil {
+		t.breaker, err = newBreaker(h.CircuitBreaker, h.now)
+		if err != nil {
+			return nil, fmt.Errorf("error provisioning circuit_breaker: %w", err)
+		}
+		t.breaker.onChange = func(from, to breakerState, requests, failures, timeouts int) {
+			h.onBreakerChange(t, from, to, requests, failures, timeouts)
+		}
+	}
+
+	return t, nil
+}
+
+// loadSubroute loads the routes of the primary or a shadow target. Loading the module also provisions it.
+func loadSubroute(ctx caddy.Context, raw json.RawMessage) (caddyhttp.MiddlewareHandler, error) {
+	mod, err := ctx.LoadModuleByID("http.handlers.subroute", raw)
+	if err != nil {
+		return nil, err
+	}
+	return mod.(caddyhttp.MiddlewareHandler), nil
+}
+
+func (h *Handler) onBreakerChange(t *target, from, to breakerState, requests, failures, timeouts int) {
+	h.slogger.Info("shadow_circuit_state_change",
+		slog.String("target", t.name),
+		slog.String("from", from.String()),
+		slog.String("to", to.String()),
+		slog.Int("requests", requests),
+		slog.Int("failures", failures),
+		slog.Int("timeouts", timeouts),
+	)
+	if h.MetricsName != "" {
+		t.metrics.circuitState.Set(float64(to))
+	}
+}
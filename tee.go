@@ -0,0 +1,65 @@
+package shadow
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+)
+
+// teeWriter streams the primary's response to the client as it's written, forwarding flushes, while capturing the
+// body for comparison. Only bodies we're able to compare are captured, up to a limit. The body is always hashed as
+// well, so a body over the limit can still be compared by hash.
+type teeWriter struct {
+	*hashingWriter
+	buf        *bytes.Buffer
+	limit      int64
+	capturing  bool
+	overflowed bool
+}
+
+// newTeeWriter captures into buf, hashing with SHA-256 as well as any other algorithms the targets compare by
+func newTeeWriter(w http.ResponseWriter, algorithms []string, buf *bytes.Buffer, limit int64) *teeWriter {
+	if !slices.Contains(algorithms, bodyHashSHA256) {
+		algorithms = append(algorithms, bodyHashSHA256)
+	}
+	return &teeWriter{hashingWriter: newHashingWriter(w, algorithms), buf: buf, limit: limit}
+}
+
+func (w *teeWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.capturing = shouldBufferResponse(status, w.Header())
+	}
+	w.hashingWriter.WriteHeader(status)
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.hashingWriter.Write(p)
+	if w.capturing && !w.overflowed {
+		if int64(w.buf.Len()+n) > w.limit {
+			// From here on, the body can only be compared by hash
+			w.overflowed = true
+			w.buf.Reset()
+		} else {
+			w.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (w *teeWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// captured returns the captured body, or reports that it was too large to capture and only its digests are left
+func (w *teeWriter) captured() (body []byte, hashOnly bool) {
+	if w.overflowed {
+		return nil, true
+	}
+	if !w.capturing {
+		return nil, false
+	}
+	return w.buf.Bytes(), false
+}
@@ -0,0 +1,106 @@
+package shadow
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTeeWriter(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		limit        int64
+		wantCaptured string
+		wantHashOnly bool
+	}{
+		{name: "under the limit", status: http.StatusOK, limit: 11, wantCaptured: "hello world"},
+		{name: "over the limit", status: http.StatusOK, limit: 8, wantHashOnly: true},
+		{name: "error status", status: http.StatusNotFound, limit: 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downstream := httptest.NewRecorder()
+			w := newTeeWriter(downstream, nil, new(bytes.Buffer), tt.limit)
+			w.WriteHeader(tt.status)
+			_, _ = w.Write([]byte("hello "))
+			http.NewResponseController(w).Flush()
+			if !downstream.Flushed || downstream.Body.String() != "hello " {
+				t.Errorf("the first chunk should be flushed to the client as it's written")
+			}
+			_, _ = w.Write([]byte("world"))
+
+			if downstream.Code != tt.status || downstream.Body.String() != "hello world" {
+				t.Errorf("downstream = %d %q, want the response passed through", downstream.Code, downstream.Body)
+			}
+			captured, hashOnly := w.captured()
+			if string(captured) != tt.wantCaptured || hashOnly != tt.wantHashOnly {
+				t.Errorf("captured() = %q, %v, want %q, %v", captured, hashOnly, tt.wantCaptured, tt.wantHashOnly)
+			}
+			if hashOnly {
+				got := response{digests: w.digests}.bodyDigest(bodyHashSHA256)
+				want := response{body: []byte("hello world")}.bodyDigest(bodyHashSHA256)
+				if !got.equal(want) {
+					t.Errorf("digest = %s, want the whole body's, %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_streamPrimary(t *testing.T) {
+	tests := []struct {
+		name     string
+		shadow   string
+		encoding string
+		limit    int64
+		want     string
+	}{
+		{name: "captured match", shadow: `{"id":1,"name":"primary"}`, limit: 1 << 20, want: "true"},
+		{name: "captured mismatch", shadow: `{"id":2,"name":"primary"}`, limit: 1 << 20, want: "false"},
+		{name: "hashed match", shadow: `{"id":1,"name":"primary"}`, limit: 8, want: "true"},
+		{name: "hashed mismatch", shadow: `{"id":2,"name":"primary"}`, limit: 8, want: "false"},
+		{name: "captured encoded", shadow: `{"id":1,"name":"primary"}`, encoding: "gzip", limit: 1 << 20, want: "true"},
+		{name: "hashed encoded", shadow: `{"id":1,"name":"primary"}`, encoding: "gzip", limit: 8, want: "skipped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downstream := httptest.NewRecorder()
+			h := newTestHandler(
+				func(w http.ResponseWriter, r *http.Request) error {
+					_, _ = w.Write([]byte(`{"id":1,`))
+					http.NewResponseController(w).Flush()
+					if !downstream.Flushed || downstream.Body.Len() == 0 {
+						t.Errorf("the primary's response should be streamed to the client as it's written")
+					}
+					_, err := w.Write([]byte(`"name":"primary"}`))
+					return err
+				},
+				func(w http.ResponseWriter, r *http.Request) error {
+					body := []byte(tt.shadow)
+					if tt.encoding != "" {
+						w.Header().Set("Content-Encoding", tt.encoding)
+						body = encode(t, tt.encoding, body)
+					}
+					_, err := w.Write(body)
+					return err
+				},
+			)
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareBody: true}
+			h.StreamPrimary, h.captureLimit = true, tt.limit
+			h.DebugHeaders = &DebugHeadersConfig{}
+
+			if err := h.ServeHTTP(downstream, prepareRequest(httptest.NewRequest("GET", "/", nil)), nextHandler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if got := downstream.Body.String(); got != `{"id":1,"name":"primary"}` {
+				t.Errorf("body = %q, want the primary's response", got)
+			}
+			res := downstream.Result()
+			if got := res.Trailer.Get(debugHeaderMatch); got != tt.want {
+				t.Errorf("%s = %q, want %q", debugHeaderMatch, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package shadow
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// VerifyConfig turns the handler into a gate. The primary's response is held back until every target which compares
+// responses is done, and is only sent if none of them differ from it.
+type VerifyConfig struct {
+	// Status is the status responded with when a target's response differs from the primary's, defaulting to 502.
+	Status int `json:"status,omitempty"`
+
+	// HandlerError returns the mismatch as a caddyhttp.HandlerError with Status, so it can be handled by
+	// handle_errors, rather than responding with a summary of the differences directly.
+	HandlerError bool `json:"handler_error,omitempty"`
+}
+
+var errVerificationFailed = errors.New("shadow verification failed")
+
+func (h *Handler) provisionVerify() error {
+	if h.Verify == nil {
+		return nil
+	}
+	if h.served != nil {
+		return fmt.Errorf("verify can't be combined with serve %q", h.Serve)
+	}
+	if h.Verify.Status == 0 {
+		h.Verify.Status = http.StatusBadGateway
+	}
+	if h.Verify.Status < 400 || h.Verify.Status > 599 {
+		return fmt.Errorf("verify status must be an error status, got %d", h.Verify.Status)
+	}
+	return nil
+}
+
+// targetCheck is the outcome of comparing a target's response with the primary's while the client waits
+type targetCheck struct {
+	comparison
+	target  *target
+	status  int
+	latency time.Duration
+}
+
+// ok reports whether the target's response can't be told apart from the primary's, or couldn't be compared because
+// the client went away, the request body was too large to mirror, or a response body couldn't be decoded
+func (c targetCheck) ok() bool {
+	return c.skipped != "" || c.match()
+}
+
+// summary describes how the target's response differs from the primary's
+func (c targetCheck) summary() string {
+	if c.err != nil {
+		return fmt.Sprintf("failed: %v", c.err)
+	}
+	return "differs in " + strings.Join(c.regressions, ", ")
+}
+
+// checkTargets waits for each target which compares responses, and compares it with the primary, the same way as in
+// the background. The shadows' buffers are returned to the pool.
+func (h *Handler) checkTargets(shadows []*shadowRequest, secondary *shadowRequest, primary response, route string, body *bodyMux) (checks []targetCheck) {
+	decodedPrimary := h.newPrimaryResponse(primary)
+	for _, s := range shadows {
+		if !s.target.shouldCompare() {
+			continue
+		}
+		<-s.done
+		checks = append(checks, h.checkTarget(s, secondary, decodedPrimary, route, body))
+		bufferPool.Put(s.buf)
+	}
+	if secondary != nil {
+		<-secondary.done
+		bufferPool.Put(secondary.buf)
+	}
+	return checks
+}
+
+func (h *Handler) checkTarget(s, secondary *shadowRequest, primary *primaryResponse, route string, body *bodyMux) targetCheck {
+	return targetCheck{
+		comparison: h.compare(s, secondary, primary, route, body),
+		target:     s.target,
+		status:     s.recorder.Status(),
+		latency:    s.latency,
+	}
+}
+
+// verificationFailures summarizes the targets which differ from the primary
+func verificationFailures(checks []targetCheck) (failures []string) {
+	for _, c := range checks {
+		if !c.ok() {
+			failures = append(failures, c.target.name+" "+c.summary())
+		}
+	}
+	return failures
+}
+
+// rejectResponse reports a failed verification, instead of sending the primary's response
+func (h *Handler) rejectResponse(w http.ResponseWriter, header http.Header, failures []string) error {
+	summary := strings.Join(failures, "; ")
+	h.slogger.Info("shadow_verification_failed", slog.String("summary", summary))
+
+	err := fmt.Errorf("%w: %s", errVerificationFailed, summary)
+	if h.Verify.HandlerError {
+		// The error is handled further up the chain, so none of the rejected primary's headers should be left for it
+		clear(w.Header())
+		maps.Copy(w.Header(), header)
+		return caddyhttp.Error(h.Verify.Status, err)
+	}
+	return writeResponse(w, header, response{
+		status: h.Verify.Status,
+		header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		body:   []byte(err.Error() + "\n"),
+	})
+}
@@ -0,0 +1,189 @@
+package shadow
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandler_ServeHTTP_verify(t *testing.T) {
+	respond := func(status int, body string) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			_, err := w.Write([]byte(body))
+			return err
+		}
+	}
+
+	tests := []struct {
+		name         string
+		shadow       handlerFunc
+		ignore       map[string][]string
+		handlerError bool
+		wantStatus   int
+		wantBody     string
+	}{
+		{
+			name:       "match",
+			shadow:     respond(http.StatusOK, `{"id":1,"at":1}`),
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":1,"at":1}`,
+		},
+		{
+			name:       "mismatch",
+			shadow:     respond(http.StatusOK, `{"id":2,"at":1}`),
+			wantStatus: http.StatusConflict,
+			wantBody:   "shadow verification failed: shadow differs in body/id\n",
+		},
+		{
+			name:       "status mismatch",
+			shadow:     respond(http.StatusNotFound, `{"id":1,"at":1}`),
+			wantStatus: http.StatusConflict,
+			wantBody:   "shadow verification failed: shadow differs in body, status\n",
+		},
+		{
+			name:       "ignored mismatch",
+			shadow:     respond(http.StatusOK, `{"id":1,"at":2}`),
+			ignore:     map[string][]string{"*": {"body/at"}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":1,"at":1}`,
+		},
+		{
+			name: "shadow error",
+			shadow: func(w http.ResponseWriter, r *http.Request) error {
+				return errors.New("shadow is down")
+			},
+			wantStatus: http.StatusConflict,
+			wantBody:   "shadow verification failed: shadow failed: shadow is down\n",
+		},
+		{
+			name:         "handler error",
+			shadow:       respond(http.StatusOK, `{"id":2,"at":1}`),
+			handlerError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Set-Cookie", "session=primary")
+				return respond(http.StatusOK, `{"id":1,"at":1}`)(w, r)
+			}
+			h := newTestHandler(primary, tt.shadow)
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareBody: true, CompareStatus: true}
+			h.IgnoreFields = tt.ignore
+			h.Verify = &VerifyConfig{Status: http.StatusConflict, HandlerError: tt.handlerError}
+
+			w := httptest.NewRecorder()
+			w.Header().Set("Server", "Caddy")
+			err := h.ServeHTTP(w, prepareRequest(httptest.NewRequest("GET", "/", nil)), nextHandler)
+			if tt.handlerError {
+				var herr caddyhttp.HandlerError
+				if !errors.As(err, &herr) || herr.StatusCode != http.StatusConflict || !errors.Is(err, errVerificationFailed) {
+					t.Errorf("ServeHTTP() error = %v, want a HandlerError with status 409", err)
+				}
+				if w.Body.Len() > 0 {
+					t.Errorf("body = %q, want nothing written", w.Body)
+				}
+				if want := (http.Header{"Server": {"Caddy"}}); !maps.EqualFunc(w.Header(), want, slices.Equal) {
+					t.Errorf("header = %v, want only the headers set before the primary, %v", w.Header(), want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody {
+				t.Errorf("response = %d %q, want %d %q", w.Code, w.Body, tt.wantStatus, tt.wantBody)
+			}
+			if tt.wantStatus != http.StatusOK && strings.Contains(w.Header().Get("Content-Type"), "json") {
+				t.Errorf("Content-Type = %q, the primary's headers should be replaced", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_verifyAgrees(t *testing.T) {
+	// The gate, debug headers, diff, logs and metrics all go by one comparison, so a body which is the same JSON in a
+	// different order fails verification just like it's logged and counted as a mismatch
+	respond := func(body string) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", "application/json")
+			_, err := w.Write([]byte(body))
+			return err
+		}
+	}
+	logs := make(logWriter, 10)
+	h := newTestHandler(respond(`{"a":1,"b":2}`), respond(`{"b":2,"a":1}`))
+	h.slogger = slog.New(slog.NewTextHandler(logs, nil))
+	h.targets[0].ComparisonConfig = ComparisonConfig{CompareBody: true}
+	h.Verify = &VerifyConfig{Status: http.StatusConflict}
+	h.DebugHeaders = &DebugHeadersConfig{}
+	h.DiffResponse = &DiffResponseConfig{Header: "X-Diff", Value: "t0ken"}
+	withMetrics(t, h)
+
+	w := httptest.NewRecorder()
+	if err := h.ServeHTTP(w, prepareRequest(httptest.NewRequest("GET", "/", nil)), nextHandler); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+	if w.Code != http.StatusConflict || w.Body.String() != "shadow verification failed: shadow differs in body\n" {
+		t.Errorf("response = %d %q, want the verification to fail", w.Code, w.Body)
+	}
+	if got := w.Header().Get(debugHeaderMatch); got != "false" {
+		t.Errorf("%s = %q, want false", debugHeaderMatch, got)
+	}
+	if mismatch := testutil.ToFloat64(h.targets[0].metrics.mismatch); mismatch != 1 {
+		t.Errorf("mismatch = %v, want 1", mismatch)
+	}
+	if line := <-logs; !strings.Contains(line, "msg=shadow_mismatch") {
+		t.Errorf("logged %s, want shadow_mismatch", line)
+	}
+
+	r := prepareRequest(httptest.NewRequest("GET", "/", nil))
+	r.Header.Set("X-Diff", "t0ken")
+	w = httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r, nextHandler); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+	var report diffReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("error decoding diff: %v", err)
+	}
+	if d := report.Targets[0]; d.Match || !slices.Equal(d.Regressions, []string{bodyField}) {
+		t.Errorf("diff match = %v with regressions %v, want a mismatch in the body", d.Match, d.Regressions)
+	}
+}
+
+func TestHandler_provisionVerify(t *testing.T) {
+	tests := []struct {
+		name       string
+		h          Handler
+		wantStatus int
+		wantErr    bool
+	}{
+		{name: "default status", h: Handler{Verify: &VerifyConfig{}}, wantStatus: http.StatusBadGateway},
+		{name: "status", h: Handler{Verify: &VerifyConfig{Status: http.StatusConflict}}, wantStatus: http.StatusConflict},
+		{name: "success status", h: Handler{Verify: &VerifyConfig{Status: http.StatusOK}}, wantErr: true},
+		{name: "serving", h: Handler{Verify: &VerifyConfig{}, served: &target{}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.h.provisionVerify()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("provisionVerify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.h.Verify.Status != tt.wantStatus {
+				t.Errorf("Status = %d, want %d", tt.h.Verify.Status, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package shadow
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	// webSocketBacklog is how many reads from the client may be waiting to be copied to a shadow. A shadow which falls
+	// further behind is dropped from the session, rather than slowing down the primary's.
+	webSocketBacklog = 64
+
+	// maxRecordedMessages caps how many messages from each side of a session are recorded for comparison
+	maxRecordedMessages = 10000
+
+	dropReasonBacklog = "backlog"
+)
+
+// isWebSocketUpgrade reports whether r is an HTTP/1.x request to switch to the WebSocket protocol
+func isWebSocketUpgrade(r *http.Request) bool {
+	if r.ProtoMajor != 1 || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketSession mirrors a WebSocket session between the client and the primary to the shadow targets. What the
+// client sends is copied to each shadow, and what the shadows send back is discarded, or recorded to be compared with
+// what the primary sent.
+type webSocketSession struct {
+	h       *Handler
+	shadows []*webSocketShadow
+
+	// primary records the primary's messages, when any target compares them
+	primary *messageRecorder
+
+	// upgraded records whether the primary switched protocols. ended is closed once the primary's session is over,
+	// or once the primary is done without switching protocols.
+	upgraded atomic.Bool
+	ended    chan struct{}
+	endOnce  sync.Once
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// webSocketShadow is a shadow's side of a mirrored session. The shadow's handler hijacks the other end of conn.
+type webSocketShadow struct {
+	*shadowRequest
+	conn   net.Conn
+	cancel context.CancelFunc
+
+	// incoming holds what the client sent, waiting to be copied to the shadow. dropped records whether the shadow
+	// fell too far behind, and is only safe to read once the session has ended.
+	incoming chan []byte
+	dropped  bool
+
+	// messages records the shadow's messages, when the target compares them. read is closed once everything the
+	// shadow sent has been read.
+	messages *messageRecorder
+	read     chan struct{}
+}
+
+// mirrorWebSocket hands the request to the primary, and mirrors its session to each target once it switches
+// protocols. A target's session ends when the shadow is done with it, or once the primary's has ended and the shadow
+// has had its timeout to finish.
+func (h *Handler) mirrorWebSocket(w http.ResponseWriter, r *http.Request, targets []*target, tickets map[*target]breakerTicket, next caddyhttp.Handler) error {
+	requestID := h.requestID(r)
+	pr := r.Clone(r.Context())
+	h.markPrimary(pr, requestID)
+
+	session := &webSocketSession{h: h, ended: make(chan struct{})}
+	for _, t := range targets {
+		if t.CompareMessages {
+			session.primary = &messageRecorder{}
+		}
+	}
+	// The handshake never has a body, and the shadows only ever get what the client sends through the session
+	sr := r.Clone(r.Context())
+	sr.Body = http.NoBody
+	for _, t := range targets {
+		s := h.startWebSocketShadow(t, tickets[t], sr, requestID, next)
+		session.shadows = append(session.shadows, s)
+		go h.finishWebSocketShadow(s, session)
+	}
+
+	err := h.requestProcessor(h.primary, nil)(&hijackWriter{ResponseWriter: w, session: session}, pr, next)
+	if !session.upgraded.Load() {
+		// Otherwise, the session ends once the primary closes the connection
+		session.end()
+	}
+	return err
+}
+
+// startWebSocketShadow mirrors the handshake to a target in the background, and starts copying what the client sends
+// to it, and reading what it sends back
+func (h *Handler) startWebSocketShadow(t *target, ticket breakerTicket, r *http.Request, requestID string, next caddyhttp.Handler) *webSocketShadow {
+	conn, shadowConn := net.Pipe()
+	s := &webSocketShadow{
+		shadowRequest: &shadowRequest{target: t, ticket: ticket, done: make(chan struct{})},
+		conn:          conn,
+		incoming:      make(chan []byte, webSocketBacklog),
+		read:          make(chan struct{}),
+	}
+	if t.CompareMessages {
+		s.messages = &messageRecorder{}
+	}
+	s.recorder = caddyhttp.NewResponseRecorder(&sessionWriter{conn: shadowConn}, nil, nil)
+
+	// The shadow's session is ended by the primary's, rather than by the request, which is done as soon as the primary
+	// is
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	s.cancel = cancel
+	h.runShadow(s.shadowRequest, r, ctx, requestID, nil, next)
+
+	go func() {
+		var err error
+		for p := range s.incoming {
+			if err == nil {
+				_, err = conn.Write(p)
+			}
+		}
+	}()
+	go func() {
+		defer close(s.read)
+		var sink io.Writer = io.Discard
+		if s.messages != nil {
+			sink = s.messages
+		}
+		_, _ = io.Copy(sink, conn)
+	}()
+
+	return s
+}
+
+// finishWebSocketShadow ends a target's session once the shadow is done with it, or once the primary's has ended and
+// the shadow has had its timeout to finish, then compares the messages each side sent
+func (h *Handler) finishWebSocketShadow(s *webSocketShadow, session *webSocketSession) {
+	select {
+	case <-s.done:
+	case <-session.ended:
+		var grace time.Duration
+		if session.upgraded.Load() {
+			grace = s.target.timeout
+		}
+		timer := time.NewTimer(grace)
+		select {
+		case <-s.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	_ = s.conn.Close()
+	s.cancel()
+
+	<-session.ended
+	<-s.read
+	<-s.done
+	if s.messages == nil || !session.upgraded.Load() {
+		return
+	}
+	if s.dropped || s.cancelled {
+		// The shadow missed part of the session, so its messages would only ever report a bogus mismatch
+		reason := "cancelled"
+		if s.dropped {
+			reason = dropReasonBacklog
+		}
+		h.slogger.Debug("shadow_comparison_skipped", slog.String("target", s.target.name), slog.String("reason", reason))
+		return
+	}
+	h.compareMessages(s.target, session.primary, s.messages)
+}
+
+// end stops copying what the client sends to the shadows
+func (s *webSocketSession) end() {
+	s.endOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		for _, shadow := range s.shadows {
+			close(shadow.incoming)
+		}
+		s.mu.Unlock()
+		close(s.ended)
+	})
+}
+
+// copyToShadows queues what the client sent to be copied to each shadow. A shadow with a full backlog is dropped
+// from the session, since it can't skip ahead.
+func (s *webSocketSession) copyToShadows(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	p = slices.Clone(p)
+	for _, shadow := range s.shadows {
+		if shadow.dropped {
+			continue
+		}
+		select {
+		case shadow.incoming <- p:
+		default:
+			shadow.dropped = true
+			_ = shadow.conn.Close()
+			t := shadow.target
+			s.h.slogger.Debug("shadow_websocket_dropped", slog.String("target", t.name), slog.String("reason", dropReasonBacklog))
+			if s.h.MetricsName != "" {
+				t.metrics.dropped.WithLabelValues(dropReasonBacklog).Inc()
+			}
+		}
+	}
+}
+
+// hijackWriter passes the primary's response through, and mirrors its connection once the primary hijacks it
+type hijackWriter struct {
+	http.ResponseWriter
+	session *webSocketSession
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+	w.session.upgraded.Store(true)
+	mc := &mirrorConn{Conn: conn, session: w.session}
+
+	// The client may have sent more than the handshake already, which is buffered rather than read through mc
+	if buffered := brw.Reader.Buffered(); buffered > 0 {
+		data, _ := brw.Peek(buffered)
+		data = slices.Clone(data)
+		w.session.copyToShadows(data)
+		brw.Reader.Reset(io.MultiReader(bytes.NewReader(data), mc))
+		_, _ = brw.Peek(buffered)
+	} else {
+		brw.Reader.Reset(mc)
+	}
+	brw.Writer.Reset(mc)
+	return mc, brw, nil
+}
+
+func (w *hijackWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// mirrorConn is the primary's hijacked connection. What the client sends is copied to the shadows, what the primary
+// sends is recorded for comparison, and closing it ends the session.
+type mirrorConn struct {
+	net.Conn
+	session *webSocketSession
+}
+
+func (c *mirrorConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.session.copyToShadows(p[:n])
+	}
+	return n, err
+}
+
+func (c *mirrorConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if c.session.primary != nil {
+		_, _ = c.session.primary.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *mirrorConn) Close() error {
+	c.session.end()
+	return c.Conn.Close()
+}
+
+// sessionWriter discards a shadow's response like NopResponseWriter, but hands it conn when it switches protocols
+type sessionWriter struct {
+	NopResponseWriter
+	conn net.Conn
+}
+
+func (w *sessionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// webSocketMessage is a data message, as its opcode and the digest of its payload
+type webSocketMessage struct {
+	opcode byte
+	digest bodyDigest
+}
+
+// messageRecorder parses the WebSocket frames one side of a session sends, and records each data message, up to
+// maxRecordedMessages of them. Control frames, like pings, aren't recorded.
+type messageRecorder struct {
+	mu       sync.Mutex
+	messages []webSocketMessage
+
+	// The frame being parsed, which is in its payload once its header is complete
+	header    []byte
+	inPayload bool
+	remaining int64
+	offset    int64
+	fin       bool
+	control   bool
+	masked    bool
+	mask      [4]byte
+
+	// The message being reassembled from its frames
+	opcode byte
+	hash   hash.Hash
+	size   int64
+}
+
+func (m *messageRecorder) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 && len(m.messages) < maxRecordedMessages {
+		if !m.inPayload {
+			k := min(frameHeaderLen(m.header)-len(m.header), len(p))
+			m.header = append(m.header, p[:k]...)
+			p = p[k:]
+			if len(m.header) == frameHeaderLen(m.header) {
+				m.startFrame()
+			}
+			continue
+		}
+
+		k := int(min(m.remaining, int64(len(p))))
+		if !m.control && m.hash != nil {
+			chunk := p[:k]
+			if m.masked {
+				chunk = slices.Clone(chunk)
+				for i := range chunk {
+					chunk[i] ^= m.mask[(m.offset+int64(i))%4]
+				}
+			}
+			_, _ = m.hash.Write(chunk)
+			m.size += int64(k)
+		}
+		p = p[k:]
+		m.offset += int64(k)
+		m.remaining -= int64(k)
+		if m.remaining == 0 {
+			m.endFrame()
+		}
+	}
+	return n, nil
+}
+
+// frameHeaderLen returns the length of a frame header, given as much of it as has been read
+func frameHeaderLen(header []byte) int {
+	if len(header) < 2 {
+		return 2
+	}
+	n := 2
+	switch header[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if header[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func (m *messageRecorder) startFrame() {
+	h := m.header
+	m.fin = h[0]&0x80 != 0
+	opcode := h[0] & 0x0f
+	m.control = opcode >= 8
+	if !m.control && opcode != 0 {
+		// Any other frame continues the message before it
+		m.opcode, m.hash, m.size = opcode, newHash(bodyHashSHA256), 0
+	}
+
+	length, i := int64(h[1]&0x7f), 2
+	switch length {
+	case 126:
+		length, i = int64(binary.BigEndian.Uint16(h[2:])), 4
+	case 127:
+		length, i = int64(binary.BigEndian.Uint64(h[2:])&(1<<63-1)), 10
+	}
+	m.masked = h[1]&0x80 != 0
+	if m.masked {
+		copy(m.mask[:], h[i:])
+	}
+
+	m.header = m.header[:0]
+	m.inPayload, m.remaining, m.offset = true, length, 0
+	if length == 0 {
+		m.endFrame()
+	}
+}
+
+func (m *messageRecorder) endFrame() {
+	m.inPayload = false
+	if m.control || !m.fin || m.hash == nil {
+		return
+	}
+	m.messages = append(m.messages, webSocketMessage{opcode: m.opcode, digest: bodyDigest{sum: m.hash.Sum(nil), size: m.size}})
+	m.hash = nil
+}
+
+// recorded returns the messages recorded so far
+func (m *messageRecorder) recorded() []webSocketMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.messages)
+}
+
+// compareMessages compares the messages the primary and a target sent in a mirrored WebSocket session, in order.
+// Sessions longer than maxRecordedMessages are only compared as far as they were recorded.
+func (h *Handler) compareMessages(t *target, primary, shadow *messageRecorder) {
+	pm, sm := primary.recorded(), shadow.recorded()
+	n := min(len(pm), len(sm))
+	first := n
+	for i := range n {
+		if pm[i].opcode != sm[i].opcode || !pm[i].digest.equal(sm[i].digest) {
+			first = i
+			break
+		}
+	}
+	match := first == n && len(pm) == len(sm)
+
+	if h.MetricsName != "" {
+		if match {
+			t.metrics.match.Inc()
+		} else {
+			t.metrics.mismatch.Inc()
+		}
+	}
+	if match || h.NoLog {
+		return
+	}
+
+	attrs := []any{
+		"target", t.name,
+		"primary_messages", len(pm),
+		"shadow_messages", len(sm),
+		"first_difference", first,
+	}
+	if first < n {
+		attrs = append(attrs,
+			"primary_message_sha256", pm[first].digest.String(),
+			"primary_message_size", pm[first].digest.size,
+			"shadow_message_sha256", sm[first].digest.String(),
+			"shadow_message_size", sm[first].digest.size,
+		)
+	}
+	h.slogger.Info("shadow_websocket_mismatch", attrs...)
+}
@@ -0,0 +1,233 @@
+package shadow
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const (
+	opText   = 0x1
+	opBinary = 0x2
+	opClose  = 0x8
+	opPing   = 0x9
+)
+
+// frame builds a WebSocket frame, masked as a client's would be
+func frame(fin bool, opcode byte, payload string, masked bool) []byte {
+	var b bytes.Buffer
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	b.WriteByte(first)
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b.WriteByte(maskBit | byte(len(payload)))
+	default:
+		b.WriteByte(maskBit | 126)
+		_ = binary.Write(&b, binary.BigEndian, uint16(len(payload)))
+	}
+	p := []byte(payload)
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		b.Write(mask)
+		for i := range p {
+			p[i] ^= mask[i%4]
+		}
+	}
+	b.Write(p)
+	return b.Bytes()
+}
+
+// readFrame reads a small frame, unmasking its payload
+func readFrame(r *bufio.Reader) (opcode byte, payload string, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return 0, "", err
+	}
+	var mask [4]byte
+	if h[1]&0x80 != 0 {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return 0, "", err
+		}
+	}
+	p := make([]byte, h[1]&0x7f)
+	if _, err = io.ReadFull(r, p); err != nil {
+		return 0, "", err
+	}
+	for i := range p {
+		p[i] ^= mask[i%4]
+	}
+	return h[0] & 0x0f, string(p), nil
+}
+
+// webSocketServer answers each message with reply, until the client closes the session. It sends each message it
+// gets to seen, if it's set.
+func webSocketServer(reply func(string) string, seen chan<- string) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Upgrade", "websocket")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		for {
+			opcode, payload, err := readFrame(brw.Reader)
+			if err != nil {
+				return nil
+			}
+			if seen != nil {
+				seen <- payload
+			}
+			if opcode == opClose {
+				_, _ = brw.Write(frame(true, opClose, "", false))
+				return brw.Flush()
+			}
+			_, _ = brw.Write(frame(true, opcode, reply(payload), false))
+			if err := brw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func TestMessageRecorder(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   []string
+	}{
+		{name: "single frames", frames: [][]byte{frame(true, opText, "hello", false), frame(true, opBinary, "", false)}, want: []string{"hello", ""}},
+		{name: "masked", frames: [][]byte{frame(true, opText, "hello", true)}, want: []string{"hello"}},
+		{name: "extended length", frames: [][]byte{frame(true, opText, long, false)}, want: []string{long}},
+		{
+			name: "fragmented around a ping",
+			frames: [][]byte{
+				frame(false, opText, "hel", false),
+				frame(true, opPing, "ping", false),
+				frame(true, 0, "lo", false),
+				frame(true, opClose, "", false),
+			},
+			want: []string{"hello"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Frames are written a byte at a time, so every field is split across writes
+			m := &messageRecorder{}
+			for _, b := range bytes.Join(tt.frames, nil) {
+				_, _ = m.Write([]byte{b})
+			}
+
+			got := m.recorded()
+			if len(got) != len(tt.want) {
+				t.Fatalf("recorded %d messages, want %d", len(got), len(tt.want))
+			}
+			for i, payload := range tt.want {
+				want := response{body: []byte(payload)}.bodyDigest(bodyHashSHA256)
+				if !got[i].digest.equal(want) {
+					t.Errorf("message %d = %s (%d bytes), want %s (%d bytes)", i, got[i].digest, got[i].digest.size, want, want.size)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_webSocket(t *testing.T) {
+	tests := []struct {
+		name         string
+		compare      bool
+		shadowReply  func(string) string
+		wantMismatch bool
+	}{
+		{name: "mirrored", shadowReply: strings.ToUpper},
+		{name: "same messages", compare: true, shadowReply: strings.ToUpper},
+		{name: "different messages", compare: true, shadowReply: strings.ToLower, wantMismatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(chan string, 10)
+			h := newTestHandler(webSocketServer(strings.ToUpper, nil), webSocketServer(tt.shadowReply, seen))
+			h.targets[0].ComparisonConfig = ComparisonConfig{CompareMessages: tt.compare}
+			logs := make(logWriter, 10)
+			h.slogger = slog.New(slog.NewTextHandler(logs, nil))
+			withMetrics(t, h)
+
+			server, client := net.Pipe()
+			received := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(client)
+				received <- b
+			}()
+			go func() {
+				for _, payload := range []string{"hello", "world"} {
+					_, _ = client.Write(frame(true, opText, payload, true))
+				}
+				_, _ = client.Write(frame(true, opClose, "", true))
+			}()
+
+			r := httptest.NewRequest("GET", "/socket", nil)
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+			downstream := &hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}
+			if err := h.ServeHTTP(downstream, prepareRequest(r), nextHandler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			want := bytes.Join([][]byte{
+				frame(true, opText, "HELLO", false),
+				frame(true, opText, "WORLD", false),
+				frame(true, opClose, "", false),
+			}, nil)
+			if got := <-received; !bytes.Equal(got, want) {
+				t.Errorf("client got %q, want only the primary's messages, %q", got, want)
+			}
+			for _, payload := range []string{"hello", "world", ""} {
+				select {
+				case got := <-seen:
+					if got != payload {
+						t.Errorf("shadow got %q, want the client's %q", got, payload)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("shadow never got the client's %q", payload)
+				}
+			}
+			if !tt.compare {
+				return
+			}
+
+			m := h.targets[0].metrics
+			for deadline := time.Now().Add(time.Second); testutil.ToFloat64(m.match)+testutil.ToFloat64(m.mismatch) == 0; {
+				if time.Now().After(deadline) {
+					t.Fatal("the messages were never compared")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if mismatch := testutil.ToFloat64(m.mismatch) > 0; mismatch != tt.wantMismatch {
+				t.Errorf("mismatch = %v, want %v", mismatch, tt.wantMismatch)
+			}
+			if tt.wantMismatch {
+				if line := <-logs; !strings.Contains(line, "shadow_websocket_mismatch") || !strings.Contains(line, "first_difference=0") {
+					t.Errorf("log = %q, want a mismatch in the first message", line)
+				}
+			}
+		})
+	}
+}